@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureIndexes creates the indexes the aggregation relies on, it's safe to
+// call repeatedly. sourceKey is unique so concurrent -dedup-key upserts of a
+// row can't both insert. Unique indexes of a sharded collection must start
+// with its shard key, shardField, empty if it isn't sharded.
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection, shardField string) error {
+	sourceKey := mongo.IndexModel{
+		Keys:    bson.D{{Key: "sourceKey", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	}
+	if shardField != "" {
+		// A sparse compound index still holds the documents without
+		// sourceKey, which would collide on their shard key.
+		sourceKey = mongo.IndexModel{
+			Keys:    bson.D{{Key: shardField, Value: 1}, {Key: "sourceKey", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"sourceKey": bson.M{"$exists": true}}),
+		}
+	}
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "levels.z", Value: 1}, {Key: "levels.key", Value: 1}}},
+		sourceKey,
+		{Keys: bson.D{{Key: "levels.geometry", Value: "2dsphere"}}},
+	})
+	return err
+}
+
+// confirm asks a yes/no question on stdin, anything but y/yes is a no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// resetCollection drops the collection and recreates its indexes, see
+// EnsureIndexes for shardField.
+func resetCollection(ctx context.Context, collection *mongo.Collection, shardField string) error {
+	if err := collection.Drop(ctx); err != nil {
+		return fmt.Errorf("drop: %w", err)
+	}
+	if err := EnsureIndexes(ctx, collection, shardField); err != nil {
+		return fmt.Errorf("ensure indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// baselineMetrics are the valid -baseline-metric values.
+var baselineMetrics = map[string]bool{
+	"ratio":  true, // count / baseline
+	"zscore": true, // (count - baseline) / stddev, sqrt(baseline) without a stddev
+}
+
+// BaselineTile is the expected count of a tile, StdDev is 0 if unknown.
+type BaselineTile struct {
+	Count  float64
+	StdDev float64
+}
+
+// Baseline maps tile, or grid cell, keys to their expected counts.
+type Baseline map[string]BaselineTile
+
+// loadBaseline reads a FeatureCollection as printed by this tool, keyed by
+// the tileKey or gridKey property with a count and optional stddev
+// property, so a run over a typical period can serve as the baseline.
+func loadBaseline(path string) (Baseline, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(content)
+	if err != nil {
+		return nil, fmt.Errorf("baseline: %w", err)
+	}
+	baseline := make(Baseline, len(fc.Features))
+	for i, feature := range fc.Features {
+		key, ok := feature.Properties["tileKey"].(string)
+		if !ok {
+			key, ok = feature.Properties["gridKey"].(string)
+		}
+		count, hasCount := feature.Properties["count"].(float64)
+		if !ok || !hasCount {
+			return nil, fmt.Errorf("baseline feature %d needs a tileKey or gridKey and a count", i)
+		}
+		stddev, _ := feature.Properties["stddev"].(float64)
+		baseline[key] = BaselineTile{Count: count, StdDev: stddev}
+	}
+	return baseline, nil
+}
+
+// baselineFromCollection aggregates another collection at level as the
+// baseline, without standard deviations.
+func baselineFromCollection(ctx context.Context, repo RecordRepo, level int, opts Options) (Baseline, error) {
+	opts.Baseline = nil
+	stats, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		return nil, fmt.Errorf("baseline: %w", err)
+	}
+	baseline := make(Baseline, len(stats))
+	for _, item := range stats {
+		baseline[item.ID] = BaselineTile{Count: float64(item.Count)}
+	}
+	return baseline, nil
+}
+
+// compareBaseline sets `baseline` and a `ratio` or `zScore` property by
+// metric, tiles missing from baseline, or whose metric is undefined, get
+// `noBaseline` instead. features are in rawRes order.
+func compareBaseline(features []GeoJSONFeatureItem, rawRes []RawStats, baseline Baseline, metric string) {
+	for i, item := range rawRes {
+		expected, ok := baseline[item.ID]
+		stddev := expected.StdDev
+		if stddev == 0 {
+			stddev = math.Sqrt(expected.Count)
+		}
+		if !ok || (expected.Count == 0 && (metric == "ratio" || stddev == 0)) {
+			features[i].Properties["noBaseline"] = true
+			continue
+		}
+		features[i].Properties["baseline"] = expected.Count
+		if metric == "ratio" {
+			features[i].Properties["ratio"] = float64(item.Count) / expected.Count
+		} else {
+			features[i].Properties["zScore"] = (float64(item.Count) - expected.Count) / stddev
+		}
+	}
+}
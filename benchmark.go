@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// benchmarkSeed fixes the synthetic points so runs are comparable.
+	benchmarkSeed = 42
+	// benchmarkRuns is how many times each aggregation is timed, the
+	// median is reported.
+	benchmarkRuns = 5
+)
+
+// benchmarkScheme is one way of indexing records compared by -benchmark,
+// new Indexer implementations like H3 or S2 are added here.
+type benchmarkScheme struct {
+	Name     string
+	Indexer  Indexer
+	GridSize float64 // Also store and aggregate a metric grid, 0 for tiles
+}
+
+var benchmarkSchemes = []benchmarkScheme{
+	{Name: "xyz", Indexer: MaptileIndexer{}},
+	{Name: "base62", Indexer: CompactIndexer{}},
+	{Name: "grid-1km", Indexer: MaptileIndexer{}, GridSize: 1000},
+}
+
+// syntheticPoints scatters n points around seedPoints from seed, 90% in
+// clusters of about 2km and the rest uniformly across the city.
+func syntheticPoints(n int, seed int64) []orb.Point {
+	rnd := rand.New(rand.NewSource(seed))
+	points := make([]orb.Point, n)
+	for i := range points {
+		if rnd.Intn(10) == 0 {
+			points[i] = orb.Point{-74.05 + rnd.Float64()*0.3, 40.6 + rnd.Float64()*0.3}
+			continue
+		}
+		center := seedPoints[rnd.Intn(len(seedPoints))].Point
+		points[i] = orb.Point{center.Lon() + rnd.NormFloat64()*0.02, center.Lat() + rnd.NormFloat64()*0.02}
+	}
+	return points
+}
+
+// BenchmarkResult is the measurements of one benchmarkScheme.
+type BenchmarkResult struct {
+	Scheme       string
+	Levels       time.Duration // Computing every record's keys
+	Insert       time.Duration
+	Index        time.Duration // Building EnsureIndexes after the insert
+	DataBytes    float64       // collStats size, uncompressed BSON
+	StorageBytes float64       // collStats storageSize, compressed on disk
+	IndexBytes   float64       // collStats totalIndexSize
+	Aggregate    time.Duration // Median aggregation latency
+	Tiles        int           // Features the aggregation returned
+}
+
+// runBenchmark indexes points with scheme into a scratch collection,
+// measures it and drops it again.
+func runBenchmark(ctx context.Context, client *mongo.Client, collection *mongo.Collection, points []orb.Point, scheme benchmarkScheme, level int, opts Options) (BenchmarkResult, error) {
+	res := BenchmarkResult{Scheme: scheme.Name}
+	saved := indexer
+	indexer = scheme.Indexer
+	defer func() { indexer = saved }()
+	opts.GridSize = scheme.GridSize
+
+	start := time.Now()
+	records := make([]Record, len(points))
+	for i, point := range points {
+		parseOpts := ParseOptions{GridSize: scheme.GridSize}
+		if len(opts.Datasets) > 0 {
+			// Spread over the -dataset ones so the aggregation matches all.
+			parseOpts.Dataset = opts.Datasets[i%len(opts.Datasets)]
+		}
+		records[i] = newRecord(point, parseOpts)
+	}
+	res.Levels = time.Since(start)
+
+	if err := collection.Drop(ctx); err != nil {
+		return res, err
+	}
+	defer collection.Drop(context.Background())
+	start = time.Now()
+	if err := insertRecords(ctx, client, collection, records, InsertOptions{}); err != nil {
+		return res, fmt.Errorf("insert: %w", err)
+	}
+	res.Insert = time.Since(start)
+	start = time.Now()
+	if err := EnsureIndexes(ctx, collection, ""); err != nil {
+		return res, fmt.Errorf("indexes: %w", err)
+	}
+	res.Index = time.Since(start)
+
+	var stats struct {
+		Size           float64 `bson:"size"`
+		StorageSize    float64 `bson:"storageSize"`
+		TotalIndexSize float64 `bson:"totalIndexSize"`
+	}
+	if err := collection.Database().RunCommand(ctx, bson.D{{Key: "collStats", Value: collection.Name()}}).Decode(&stats); err != nil {
+		return res, fmt.Errorf("collStats: %w", err)
+	}
+	res.DataBytes, res.StorageBytes, res.IndexBytes = stats.Size, stats.StorageSize, stats.TotalIndexSize
+
+	repo, _ := xmongo.NewRepo[Record](collection)
+	latencies := make([]time.Duration, benchmarkRuns)
+	for i := range latencies {
+		start = time.Now()
+		tiles, err := aggregate(ctx, repo, level, opts)
+		if err != nil {
+			return res, err
+		}
+		latencies[i], res.Tiles = time.Since(start), len(tiles)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.Aggregate = latencies[len(latencies)/2]
+	return res, nil
+}
+
+// benchmarkDemo runs every benchmarkScheme on n synthetic points in
+// `<collection>_bench_<scheme>` collections and prints a comparison.
+func benchmarkDemo(ctx context.Context, client *mongo.Client, database, collection string, n, level int, opts Options) {
+	db := client.Database(database)
+	points := syntheticPoints(n, benchmarkSeed)
+	results := make([]BenchmarkResult, 0, len(benchmarkSchemes))
+	for _, scheme := range benchmarkSchemes {
+		res, err := runBenchmark(ctx, client, db.Collection(collection+"_bench_"+scheme.Name), points, scheme, level, opts)
+		if err != nil {
+			panic(fmt.Errorf("benchmark %s: %w", scheme.Name, err))
+		}
+		results = append(results, res)
+	}
+	ms := func(d time.Duration) string { return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000) }
+	fmt.Printf("%d synthetic points, aggregation at level %d, median of %d runs\n\n", n, level, benchmarkRuns)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "SCHEME\tLEVELS MS\tINSERT MS\tINDEX MS\tDATA MB\tSTORAGE MB\tINDEX MB\tAGGREGATE MS\tTILES\t")
+	for _, res := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.2f\t%.2f\t%.2f\t%s\t%d\t\n", res.Scheme, ms(res.Levels), ms(res.Insert), ms(res.Index),
+			res.DataBytes/1e6, res.StorageBytes/1e6, res.IndexBytes/1e6, ms(res.Aggregate), res.Tiles)
+	}
+	w.Flush()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// wsFlushInterval is how long /ws sums changes before sending them, so a
+// burst of inserts into one tile becomes a single message.
+const wsFlushInterval = 250 * time.Millisecond
+
+// wsReadLimit bounds messages read from /ws clients, which only need to
+// send control frames.
+const wsReadLimit = 1 << 16
+
+// wsUpgrader keeps gorilla's same origin check, like the other endpoints
+// which send no CORS headers.
+var wsUpgrader = websocket.Upgrader{}
+
+// ChangeSource opens change streams, *mongo.Collection implements it.
+type ChangeSource interface {
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+// TileDelta is a /ws message, the change of a tile's count.
+type TileDelta struct {
+	TileKey string `json:"tileKey"`
+	Z       int    `json:"z"`
+	Delta   int    `json:"delta"`
+}
+
+type changeEvent struct {
+	OperationType            string  `bson:"operationType"`
+	FullDocument             *Record `bson:"fullDocument"`
+	FullDocumentBeforeChange *Record `bson:"fullDocumentBeforeChange"`
+}
+
+// buildChangePipeline filters inserts and deletes of records matching
+// buildMatch, deletes by their pre-image. Deletes without a pre-image pass
+// so handleWS can tell they're missing.
+func buildChangePipeline(level int, opts Options) bson.A {
+	inserted := bson.M{"operationType": "insert"}
+	deleted := bson.M{"operationType": "delete"}
+	for path, condition := range buildMatch(level, opts) {
+		inserted["fullDocument."+path] = condition
+		deleted["fullDocumentBeforeChange."+path] = condition
+	}
+	withoutPreImage := bson.M{"operationType": "delete", "fullDocumentBeforeChange": nil}
+	return bson.A{bson.M{"$match": bson.M{"$or": bson.A{inserted, deleted, withoutPreImage}}}}
+}
+
+// recordTile returns the key of the tile, or grid cell, record counts in at
+// z, false if it has none.
+func recordTile(record *Record, z int, opts Options) (string, bool) {
+	if opts.GridSize > 0 {
+		if record.Grid == nil {
+			return "", false
+		}
+		return record.Grid.Key, true
+	}
+	for _, tile := range record.Levels {
+		if int(tile.Z) == z {
+			_, key := splitDatasetKey(tile.Key)
+			return expandKey(key), true
+		}
+	}
+	return "", false
+}
+
+// handleWS sends the level's FeatureCollection, then TileDelta messages as
+// records are inserted or deleted.
+//
+//	/ws?level=12
+//
+// The change stream opens before the snapshot is aggregated, so a change
+// racing the snapshot may be counted twice, never missed. Deletes need
+// pre-images, changeStreamPreAndPostImages on MongoDB 6.0, and are skipped
+// without. Updates aren't followed since records are never moved.
+func handleWS(w http.ResponseWriter, r *http.Request, repo RecordRepo, changes ChangeSource, defaultLevel int, opts Options) {
+	level, err := parseLevel(r, defaultLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Window > 0 || opts.Band != nil || opts.Ring != nil {
+		http.Error(w, "/ws counts can't follow -window, -row, -column or -ring", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream, err := changes.Watch(ctx, buildChangePipeline(level, opts),
+		options.ChangeStream().SetFullDocumentBeforeChange(options.WhenAvailable))
+	if err != nil {
+		http.Error(w, "change stream, needs a replica set: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close(context.Background())
+	snapshotCtx, cancelSnapshot := context.WithTimeout(ctx, requestTimeout)
+	stats, err := aggregate(snapshotCtx, repo, level, opts)
+	cancelSnapshot()
+	if err != nil {
+		writeAggregateError(w, err)
+		return
+	}
+
+	// Upgrade replies with an error itself.
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	defer conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	if err := conn.WriteJSON(toFeatureCollection(stats, opts)); err != nil {
+		return
+	}
+	conn.SetReadLimit(wsReadLimit)
+	go func() {
+		// Pings are answered by the default handler, other messages are
+		// ignored until the client closes.
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				break
+			}
+		}
+		cancel()
+	}()
+
+	z := storedZoom(level, opts)
+	events := make(chan changeEvent)
+	go func() {
+		defer close(events)
+		for stream.Next(ctx) {
+			var event changeEvent
+			if err := stream.Decode(&event); err != nil {
+				log.Println("/ws decode:", err)
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(wsFlushInterval)
+	defer ticker.Stop()
+	deltas := make(map[string]int)
+	order := make([]string, 0)
+	warned := false
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			record, sign := event.FullDocument, 1
+			if event.OperationType == "delete" {
+				record, sign = event.FullDocumentBeforeChange, -1
+			}
+			if record == nil {
+				if !warned {
+					log.Println("/ws skipping deletes without pre-images, enable changeStreamPreAndPostImages")
+					warned = true
+				}
+				continue
+			}
+			key, ok := recordTile(record, z, opts)
+			if !ok {
+				continue
+			}
+			count := 1
+			if record.Count != nil {
+				count = *record.Count
+			}
+			if _, seen := deltas[key]; !seen {
+				order = append(order, key)
+			}
+			deltas[key] += sign * count
+		case <-ticker.C:
+			for _, key := range order {
+				if deltas[key] == 0 {
+					continue
+				}
+				if err := conn.WriteJSON(TileDelta{TileKey: key, Z: z, Delta: deltas[key]}); err != nil {
+					return
+				}
+			}
+			deltas, order = make(map[string]int), order[:0]
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// checkpointBatchSize is how many records are inserted between checkpoint
+// writes, a resumed import re-sends at most one batch.
+const checkpointBatchSize = 10000
+
+// readCheckpoint returns the last inserted Record.Row saved at path, false
+// if there's no checkpoint yet.
+func readCheckpoint(path string) (int, bool, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	row, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, false, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return row, true, nil
+}
+
+// writeCheckpoint saves row at path, through a rename so a crash never
+// leaves a truncated checkpoint.
+func writeCheckpoint(path string, row int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(row)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// insertCheckpointed is insertRecords in batches of checkpointBatchSize,
+// saving the Row of each batch's last record at path once it's written.
+// With resume, records up to the saved row are skipped, which needs the
+// same input parsed the same way.
+//
+// A batch interrupted midway is sent again on resume. -dedup-key upserts it
+// instead of inserting duplicates, with only -deterministic-ids its
+// already written records fail as duplicate keys.
+func insertCheckpointed(ctx context.Context, client *mongo.Client, collection *mongo.Collection, records []Record, opts InsertOptions, path string, resume bool) error {
+	if resume {
+		last, ok, err := readCheckpoint(path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			skip := 0
+			for skip < len(records) && records[skip].Row <= last {
+				skip++
+			}
+			log.Printf("resuming after row %d, skipping %d records", last, skip)
+			records = records[skip:]
+		}
+	}
+	for start := 0; start < len(records); start += checkpointBatchSize {
+		end := start + checkpointBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err := insertRecords(ctx, client, collection, records[start:end], opts); err != nil {
+			return fmt.Errorf("insert records %d-%d, resume from %s: %w", start, end, path, err)
+		}
+		if err := writeCheckpoint(path, records[end-1].Row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
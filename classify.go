@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// classifiers map the -classify flag values to a function computing
+// buckets+1 ascending breaks from the first to the last count.
+var classifiers = map[string]func(counts []int, buckets int) []float64{
+	"quantile": quantileBreaks,
+	"equal":    equalIntervalBreaks,
+}
+
+// quantileBreaks puts roughly the same number of tiles in each bucket.
+func quantileBreaks(counts []int, buckets int) []float64 {
+	sorted := make([]int, len(counts))
+	copy(sorted, counts)
+	sort.Ints(sorted)
+	breaks := make([]float64, buckets+1)
+	for i := range breaks {
+		breaks[i] = float64(sorted[i*(len(sorted)-1)/buckets])
+	}
+	return breaks
+}
+
+// equalIntervalBreaks splits min..max into buckets ranges of equal width.
+func equalIntervalBreaks(counts []int, buckets int) []float64 {
+	min, max := counts[0], counts[0]
+	for _, count := range counts {
+		if count < min {
+			min = count
+		}
+		if count > max {
+			max = count
+		}
+	}
+	breaks := make([]float64, buckets+1)
+	for i := range breaks {
+		breaks[i] = float64(min) + float64(i)*float64(max-min)/float64(buckets)
+	}
+	return breaks
+}
+
+// bucketOf returns the index of the last break not greater than count,
+// the maximum belongs to the last bucket.
+func bucketOf(breaks []float64, count int) int {
+	bucket := sort.Search(len(breaks), func(i int) bool { return breaks[i] > float64(count) }) - 1
+	if bucket < 0 {
+		return 0
+	}
+	if bucket > len(breaks)-2 {
+		return len(breaks) - 2
+	}
+	return bucket
+}
+
+// classify assigns each feature a `bucket` property and returns the breaks.
+func classify(features []GeoJSONFeatureItem, rawRes []RawStats, opts Options) []float64 {
+	if opts.Buckets <= 0 || len(rawRes) == 0 {
+		return nil
+	}
+	counts := make([]int, len(rawRes))
+	for i, item := range rawRes {
+		counts[i] = item.Count
+	}
+	breaks := classifiers[opts.Classify](counts, opts.Buckets)
+	for i, item := range rawRes {
+		features[i].Properties["bucket"] = bucketOf(breaks, item.Count)
+	}
+	return breaks
+}
+
+// CountBin is how many tiles have a count in [Min, next boundary), Min is
+// "other" for counts outside the boundaries.
+type CountBin struct {
+	Min   interface{} `bson:"_id" json:"min"`
+	Tiles int         `bson:"tiles" json:"tiles"`
+}
+
+type CountBinSummary struct {
+	Level      int        `json:"level"`
+	Boundaries []int      `json:"boundaries"`
+	Bins       []CountBin `json:"bins"`
+}
+
+// parseBoundaries parses ascending comma separated integers.
+func parseBoundaries(raw string) ([]int, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("need at least 2 boundaries, got %q", raw)
+	}
+	boundaries := make([]int, len(parts))
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid boundary %q", part)
+		}
+		if i > 0 && v <= boundaries[i-1] {
+			return nil, fmt.Errorf("boundaries must be ascending, got %q", raw)
+		}
+		boundaries[i] = v
+	}
+	return boundaries, nil
+}
+
+// binCounts groups tiles by their count with a server side $bucket, so only
+// the per bin tile totals are transferred.
+func binCounts(ctx context.Context, repo RecordRepo, level int, boundaries []int, opts Options) (CountBinSummary, error) {
+	opts.Sort, opts.Geometry = "", ""
+	pipes := append(buildPipeline(level, opts), bson.M{
+		"$bucket": bson.M{
+			"groupBy":    "$count",
+			"boundaries": boundaries,
+			"default":    "other",
+			"output":     bson.M{"tiles": bson.M{"$sum": 1}},
+		},
+	})
+	cursor, err := repo.Aggregate(ctx, pipes, aggregateOptions(opts))
+	if err != nil {
+		return CountBinSummary{}, fmt.Errorf("aggregate: %w", err)
+	}
+	bins, err := xmongo.Decode[CountBin](ctx, cursor)
+	if err != nil {
+		return CountBinSummary{}, fmt.Errorf("decode: %w", err)
+	}
+	return CountBinSummary{Level: level, Boundaries: boundaries, Bins: bins}, nil
+}
+
+func binDemo(ctx context.Context, repo RecordRepo, level int, boundaries []int, opts Options) {
+	summary, err := binCounts(ctx, repo, level, boundaries, opts)
+	if err != nil {
+		log.Panicln("Bucket err", err.Error())
+	}
+	printJSON(summary, opts.Indent)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// resolveCollections expands comma separated collection names and path.Match
+// globs like `bar_2024_*` against the collections of db.
+func resolveCollections(ctx context.Context, db *mongo.Database, raw string) ([]string, error) {
+	existing, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("list collections: %w", err)
+	}
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, pattern := range strings.Split(raw, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid collection pattern %q: %w", pattern, err)
+		}
+		matched := false
+		for _, name := range existing {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = true
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no collection matches %q", pattern)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// mergeStats sums counts of the same key across parts, centroids are
+// averaged weighted by count.
+func mergeStats(parts [][]RawStats, order string) []RawStats {
+	merged := make(map[string]*RawStats)
+	sums := make(map[string][2]float64)
+	for _, part := range parts {
+		for _, item := range part {
+			total, ok := merged[item.ID]
+			if !ok {
+				total = &RawStats{ID: item.ID}
+				merged[item.ID] = total
+			}
+			total.Count += item.Count
+			if item.Lng != nil && item.Lat != nil {
+				sum := sums[item.ID]
+				sums[item.ID] = [2]float64{sum[0] + *item.Lng*float64(item.Count), sum[1] + *item.Lat*float64(item.Count)}
+			}
+		}
+	}
+	res := make([]RawStats, 0, len(merged))
+	for key, item := range merged {
+		if sum, ok := sums[key]; ok && item.Count > 0 {
+			lng, lat := sum[0]/float64(item.Count), sum[1]/float64(item.Count)
+			item.Lng, item.Lat = &lng, &lat
+		}
+		res = append(res, *item)
+	}
+	sortStats(res, order)
+	return res
+}
+
+// aggregateCollections runs aggregate on each named collection of db and
+// merges the results in Go, so it works on servers without $unionWith.
+// Per collection totals are logged with report.
+func aggregateCollections(ctx context.Context, db *mongo.Database, names []string, level int, opts Options, report bool) ([]RawStats, error) {
+	// Each collection's counts are partial, the floor, -kernel and the
+	// clipping after grouping apply to their sum. Spread kernels only add up
+	// from the same bandwidth, and clipping first would drop the neighbors'
+	// share.
+	partOpts := opts
+	partOpts.MinCount, partOpts.Kernel, partOpts.ROI, partOpts.Boundary = MinCounts{}, 0, nil, nil
+	if opts.Kernel > 0 {
+		// spreadKernel starts from each tile's centroid.
+		partOpts.Geometry = "centroid"
+	}
+	parts := make([][]RawStats, 0, len(names))
+	for _, name := range names {
+		repo, _ := xmongo.NewRepo[Record](db.Collection(name))
+		stats, err := aggregate(ctx, repo, level, partOpts)
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", name, err)
+		}
+		if report {
+			log.Printf("collection %s: %d tiles, count %d", name, len(stats), totalCount(stats))
+		}
+		parts = append(parts, stats)
+	}
+	res := filterMinCount(mergeStats(parts, opts.Sort), minCountFloor(level, opts))
+	if opts.Kernel > 0 {
+		var err error
+		res, err = spreadKernel(res, storedZoom(level, opts), opts.Kernel, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ROI != nil {
+		res = clipToBound(res, *opts.ROI, opts)
+	}
+	if opts.Boundary != nil {
+		res = clipToPolygon(res, opts.Boundary, opts)
+	}
+	return res, nil
+}
+
+// supportsUnionWith reports whether the server is MongoDB 4.4 or newer.
+func supportsUnionWith(ctx context.Context, db *mongo.Database) (bool, error) {
+	var info struct {
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return false, fmt.Errorf("buildInfo: %w", err)
+	}
+	if len(info.VersionArray) < 2 {
+		return false, fmt.Errorf("buildInfo: unexpected versionArray %v", info.VersionArray)
+	}
+	major, minor := info.VersionArray[0], info.VersionArray[1]
+	return major > 4 || major == 4 && minor >= 4, nil
+}
+
+// unionCollections aggregates names with $unionWith stages on the first
+// collection, so the database does the merge.
+func unionCollections(ctx context.Context, db *mongo.Database, names []string, level int, opts Options) ([]RawStats, error) {
+	repo, _ := xmongo.NewRepo[Record](db.Collection(names[0]))
+	opts.UnionWith = names[1:]
+	return aggregate(ctx, repo, level, opts)
+}
+
+func collectionsDemo(ctx context.Context, db *mongo.Database, names []string, level int, opts Options, report, union bool) {
+	var rawRes []RawStats
+	var err error
+	if union && opts.Search == "" && !report {
+		union, err = supportsUnionWith(ctx, db)
+		if err != nil {
+			log.Panicln("Version err", err.Error())
+		}
+		if !union {
+			log.Println("WARN $unionWith needs MongoDB 4.4, merging collections in Go")
+		}
+	} else {
+		union = false
+	}
+	if union {
+		rawRes, err = unionCollections(ctx, db, names, level, opts)
+	} else {
+		rawRes, err = aggregateCollections(ctx, db, names, level, opts, report)
+	}
+	if err != nil {
+		log.Panicln("Aggregate err", err.Error())
+	}
+	opts.Source = db.Name() + "." + strings.Join(names, ",")
+	if err := writeOutput(os.Stdout, rawRes, storedZoom(level, opts), opts); err != nil {
+		log.Panicln("Output err", err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+)
+
+// countryNameProperties are the feature properties -country is compared
+// with, covering Natural Earth and OpenStreetMap style exports.
+var countryNameProperties = []string{"name", "NAME", "name_en", "ADMIN", "iso_a2", "ISO_A2", "iso_a3", "ISO_A3"}
+
+// hasCountryName reports if any name property of feature equals name,
+// ignoring case.
+func hasCountryName(feature *geojson.Feature, name string) bool {
+	for _, property := range countryNameProperties {
+		if v, ok := feature.Properties[property].(string); ok && strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCountryBoundary reads the Polygons and MultiPolygons of the features
+// in a GeoJSON file named name, all of them if name is empty. Unlike -mask,
+// ring orientation isn't checked since the test is planar.
+func loadCountryBoundary(path, name string) (orb.MultiPolygon, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(content)
+	if err != nil || fc.Type != "FeatureCollection" {
+		feature, err := geojson.UnmarshalFeature(content)
+		if err != nil {
+			return nil, fmt.Errorf("need a GeoJSON FeatureCollection or Feature: %w", err)
+		}
+		fc = geojson.NewFeatureCollection().Append(feature)
+	}
+	var boundary orb.MultiPolygon
+	for _, feature := range fc.Features {
+		if name != "" && !hasCountryName(feature, name) {
+			continue
+		}
+		switch g := feature.Geometry.(type) {
+		case orb.Polygon:
+			boundary = append(boundary, g)
+		case orb.MultiPolygon:
+			boundary = append(boundary, g...)
+		}
+	}
+	if len(boundary) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("no polygon feature with a %s of %q", strings.Join(countryNameProperties, ", "), name)
+		}
+		return nil, fmt.Errorf("no polygon features in %s", path)
+	}
+	return boundary, nil
+}
+
+// clipToPolygon keeps tiles whose center lies inside boundary.
+func clipToPolygon(rawRes []RawStats, boundary orb.MultiPolygon, opts Options) []RawStats {
+	bound := boundary.Bound()
+	res := make([]RawStats, 0, len(rawRes))
+	for _, item := range rawRes {
+		center, err := cellCenter(item.ID, opts)
+		if err != nil || !bound.Contains(center) || !planar.MultiPolygonContains(boundary, center) {
+			continue
+		}
+		res = append(res, item)
+	}
+	return res
+}
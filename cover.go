@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkt"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxCoverTiles bounds how many tiles a line or polygon may cover at a
+// single zoom, at zoom 13 that's a shape of about 80km across.
+const maxCoverTiles = 256
+
+// SetLevelsCovering stores every map tile g touches at each zoom, so the
+// aggregation counts the record once in each of them. Points keep the
+// single tile of SetLevels.
+func (r *Record) SetLevelsCovering(g orb.Geometry) error {
+	r.Levels = make([]Tile, 0, maxZoom-minZoom+1)
+	for z := minZoom; z <= maxZoom; z++ {
+		set, err := projection.Cover(g, maptile.Zoom(z))
+		if err != nil {
+			return err
+		}
+		if len(set) > maxCoverTiles {
+			return fmt.Errorf("covers %d tiles at zoom %d, over the limit of %d", len(set), z, maxCoverTiles)
+		}
+		tiles := make([]maptile.Tile, 0, len(set))
+		for tile := range set {
+			tiles = append(tiles, tile)
+		}
+		sort.Slice(tiles, func(i, j int) bool {
+			if tiles[i].Y != tiles[j].Y {
+				return tiles[i].Y < tiles[j].Y
+			}
+			return tiles[i].X < tiles[j].X
+		})
+		for _, tile := range tiles {
+			r.Levels = append(r.Levels, Tile{X: tile.X, Y: tile.Y, Z: uint32(tile.Z), Key: TileKey(tile)})
+		}
+	}
+	return nil
+}
+
+// parseShape parses a WKT geometry of lng lat coordinates.
+func parseShape(raw string) (orb.Geometry, error) {
+	g, err := wkt.Unmarshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WKT %q: %v", raw, err)
+	}
+	b := g.Bound()
+	for _, corner := range []orb.Point{b.Min, b.Max} {
+		if err := validatePoint(corner, false); err != nil {
+			return nil, fmt.Errorf("WKT geometry %q: %w", raw, err)
+		}
+	}
+	return g, nil
+}
+
+// newShapeRecord builds a record from a WKT geometry. Points go through
+// newRecord. Other shapes keep their WKT in Shape, get covering levels and
+// are located, and gridded with -grid-size, at their centroid.
+func newShapeRecord(raw string, opts ParseOptions) (Record, error) {
+	g, err := parseShape(raw)
+	if err != nil {
+		return Record{}, err
+	}
+	if point, ok := g.(orb.Point); ok {
+		return newRecord(point, opts), nil
+	}
+	centroid, _ := planar.CentroidArea(g)
+	record := Record{
+		ID:       primitive.NewObjectID(),
+		Location: GeoPoint{Type: "Point", Coordinates: []float64{centroid.Lon(), centroid.Lat()}},
+		Shape:    wkt.MarshalString(g),
+	}
+	if opts.GridSize > 0 {
+		cell := GridCellAt(centroid, opts.GridSize)
+		record.Grid = &cell
+	}
+	start := time.Now()
+	if err := record.SetLevelsCovering(g); err != nil {
+		return Record{}, err
+	}
+	record.SetDataset(opts.Dataset)
+	if opts.TileGeometry {
+		record.SetLevelGeometries()
+	}
+	if opts.Timings != nil {
+		opts.Timings.SetLevels += time.Since(start)
+	}
+	return record, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// datasetSeparator joins a -dataset namespace and a tile key, it appears
+// in neither.
+const datasetSeparator = ":"
+
+var datasetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseDatasets parses comma separated dataset names.
+func parseDatasets(raw string) ([]string, error) {
+	datasets := strings.Split(raw, ",")
+	for i, dataset := range datasets {
+		datasets[i] = strings.TrimSpace(dataset)
+		if !datasetNamePattern.MatchString(datasets[i]) {
+			return nil, fmt.Errorf("invalid dataset %q, use letters, digits, _ and -", dataset)
+		}
+	}
+	return datasets, nil
+}
+
+// splitDatasetKey returns the dataset and tile key of a stored key, an
+// empty dataset if it has none.
+func splitDatasetKey(key string) (dataset, tileKey string) {
+	if i := strings.Index(key, datasetSeparator); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// SetDataset prefixes every level key with `<dataset>:`, nothing if
+// dataset is empty.
+func (r *Record) SetDataset(dataset string) {
+	if dataset == "" {
+		return
+	}
+	for i := range r.Levels {
+		r.Levels[i].Key = dataset + datasetSeparator + r.Levels[i].Key
+	}
+}
+
+// datasetKeyMatch rewrites a `levels.key` condition, nil, a key, an $in of
+// keys or a regex, to match those keys in any of datasets.
+func datasetKeyMatch(condition interface{}, datasets []string) interface{} {
+	prefix := func(key interface{}) bson.A {
+		keys := make(bson.A, len(datasets))
+		for i, dataset := range datasets {
+			keys[i] = dataset + datasetSeparator + key.(string)
+		}
+		return keys
+	}
+	alternatives := "(?:" + strings.Join(datasets, "|") + ")" + datasetSeparator
+	switch c := condition.(type) {
+	case string:
+		return bson.M{"$in": prefix(c)}
+	case bson.M:
+		keys := bson.A{}
+		for _, key := range c["$in"].(bson.A) {
+			keys = append(keys, prefix(key)...)
+		}
+		return bson.M{"$in": keys}
+	case primitive.Regex:
+		return primitive.Regex{Pattern: "^" + alternatives + strings.TrimPrefix(c.Pattern, "^"), Options: c.Options}
+	}
+	return primitive.Regex{Pattern: "^" + alternatives}
+}
+
+// setDatasetMatch applies datasetKeyMatch to match for opts.Datasets.
+func setDatasetMatch(match bson.M, opts Options) {
+	if len(opts.Datasets) > 0 {
+		match["levels.key"] = datasetKeyMatch(match["levels.key"], opts.Datasets)
+	}
+}
+
+// levelKey is the expression grouping on `levels.key`, without the dataset
+// with -dataset, so tiles of several datasets sum together.
+func levelKey(opts Options) interface{} {
+	if len(opts.Datasets) == 0 {
+		return "$levels.key"
+	}
+	return bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$levels.key", datasetSeparator}}, 1}}
+}
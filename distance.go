@@ -0,0 +1,23 @@
+package main
+
+import "math"
+
+// earthRadius is the mean Earth radius in meters.
+const earthRadius = 6371008.8
+
+// haversine returns the great-circle distance in meters between two
+// lng/lat points.
+func haversine(a, b [2]float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (b[1] - a[1]) * toRad
+	dLng := (b[0] - a[0]) * toRad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a[1]*toRad)*math.Cos(b[1]*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// TileDistance returns the great-circle distance in meters between the
+// centers of two tiles.
+func TileDistance(a, b Tile) float64 {
+	return haversine(a.Center(), b.Center())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestTileDistance compares TileDistance at maxZoom with known city pair
+// distances, within 1% to allow for tile centers being off the exact city
+// point.
+func TestTileDistance(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     orb.Point
+		distance float64
+	}{
+		{"New York - London", orb.Point{-74.0060, 40.7128}, orb.Point{-0.1278, 51.5074}, 5570e3},
+		{"Paris - Berlin", orb.Point{2.3522, 48.8566}, orb.Point{13.4050, 52.5200}, 878e3},
+		{"Tokyo - Sydney", orb.Point{139.6917, 35.6895}, orb.Point{151.2093, -33.8688}, 7823e3},
+		{"same point", orb.Point{2.3522, 48.8566}, orb.Point{2.3522, 48.8566}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := projection.At(tt.a, maptile.Zoom(maxZoom))
+			b := projection.At(tt.b, maptile.Zoom(maxZoom))
+			got := TileDistance(Tile{X: a.X, Y: a.Y, Z: uint32(a.Z)}, Tile{X: b.X, Y: b.Y, Z: uint32(b.Z)})
+			if math.Abs(got-tt.distance) > 0.01*tt.distance {
+				t.Errorf("TileDistance %.0fm, expected about %.0fm", got, tt.distance)
+			}
+		})
+	}
+}
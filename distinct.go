@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/bits"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// distinctSampleSize is how many records the -distinct cardinality
+	// estimate samples.
+	distinctSampleSize = 1000
+	// distinctValueOverhead approximates the bytes MongoDB needs per set
+	// member besides the value itself.
+	distinctValueOverhead = 16
+	// hllPrecision gives 1024 registers, 1KB per tile and a standard error
+	// of 1.04/sqrt(1024), about 3.3%.
+	hllPrecision = 10
+)
+
+// DistinctEstimate is the extrapolated number and size of distinct values.
+type DistinctEstimate struct {
+	Values int
+	Bytes  int
+}
+
+// estimateDistinct samples the records matched at level. With d distinct
+// values among s sampled of n matched, f1 of them seen once, it estimates
+// d - f1 + f1*n/s: repeated values are assumed complete, singletons to be
+// as common in the rest. That errs high for long tails, which suits a guard.
+func estimateDistinct(ctx context.Context, repo RecordRepo, level int, opts Options) (DistinctEstimate, error) {
+	match := bson.M{"$match": buildMatch(level, opts)}
+	cursor, err := repo.Aggregate(ctx, bson.A{match, bson.M{"$count": "n"}})
+	if err != nil {
+		return DistinctEstimate{}, err
+	}
+	var counted []struct {
+		N int `bson:"n"`
+	}
+	if err := cursor.All(ctx, &counted); err != nil || len(counted) == 0 {
+		return DistinctEstimate{}, err
+	}
+	n := counted[0].N
+	cursor, err = repo.Aggregate(ctx, bson.A{
+		match,
+		bson.M{"$sample": bson.M{"size": distinctSampleSize}},
+		bson.M{"$project": bson.M{"_id": 0, "value": "$properties." + opts.DistinctField}},
+	})
+	if err != nil {
+		return DistinctEstimate{}, err
+	}
+	defer cursor.Close(ctx)
+	seen := make(map[string]int)
+	sampled, size := 0, 0
+	for cursor.Next(ctx) {
+		sampled++
+		value := cursor.Current.Lookup("value")
+		if value.Type == 0 {
+			continue
+		}
+		key := string(append([]byte{byte(value.Type)}, value.Value...))
+		if seen[key] == 0 {
+			size += len(value.Value)
+		}
+		seen[key]++
+	}
+	if err := cursor.Err(); err != nil || len(seen) == 0 {
+		return DistinctEstimate{}, err
+	}
+	singletons := 0
+	for _, count := range seen {
+		if count == 1 {
+			singletons++
+		}
+	}
+	values := len(seen) - singletons + singletons*n/sampled
+	return DistinctEstimate{Values: values, Bytes: values * (size/len(seen) + distinctValueOverhead)}, nil
+}
+
+// checkDistinctMemory reports if -distinct should be approximated, since
+// an exact $addToSet would need more than DistinctMemoryMB, and errors in
+// that case unless DistinctApprox allows it.
+func checkDistinctMemory(ctx context.Context, repo RecordRepo, level int, opts Options) (bool, error) {
+	if opts.DistinctField == "" || opts.DistinctMemoryMB <= 0 {
+		return false, nil
+	}
+	estimate, err := estimateDistinct(ctx, repo, level, opts)
+	if err != nil {
+		return false, fmt.Errorf("estimate distinct: %w", err)
+	}
+	if estimate.Bytes <= opts.DistinctMemoryMB<<20 {
+		return false, nil
+	}
+	if !opts.DistinctApprox {
+		return false, fmt.Errorf("-distinct %s needs about %dMB for %d values, over -limit-distinct-memory %dMB, use -distinct-approx or a narrower query",
+			opts.DistinctField, estimate.Bytes>>20, estimate.Values, opts.DistinctMemoryMB)
+	}
+	log.Printf("-distinct %s estimated at %d values, about %dMB, counting approximately", opts.DistinctField, estimate.Values, estimate.Bytes>>20)
+	return true, nil
+}
+
+// hyperLogLog estimates how many distinct values were added.
+type hyperLogLog [1 << hllPrecision]uint8
+
+func (h *hyperLogLog) Add(value []byte) {
+	f := fnv.New64a()
+	f.Write(value)
+	// FNV's high bits mix poorly, finish with splitmix64.
+	x := f.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	register := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h[register] {
+		h[register] = rank
+	}
+}
+
+func (h *hyperLogLog) Count() int {
+	m := float64(len(h))
+	sum, zeros := 0.0, 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// aggregateApproxDistinct is aggregate with -distinct counted in a per tile
+// HyperLogLog. The final $group becomes a $project of its key, so the
+// server streams one small document per record and level instead of
+// holding every set, and the grouping happens here.
+func aggregateApproxDistinct(ctx context.Context, repo RecordRepo, level int, opts Options) ([]RawStats, error) {
+	field, order, floor := opts.DistinctField, opts.Sort, minCountFloor(level, opts)
+	opts.DistinctField, opts.Sort, opts.MinCount = "", "", MinCounts{}
+	pipes := buildPipeline(level, opts)
+	group := pipes[len(pipes)-1].(bson.M)["$group"].(bson.M)
+	project := bson.M{
+		"_id":   0,
+		"key":   group["_id"],
+		"count": bson.M{"$ifNull": bson.A{"$count", 1}},
+		"value": "$properties." + field,
+	}
+	if opts.Geometry == "centroid" || opts.Kernel > 0 {
+		project["lng"] = bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 0}}
+		project["lat"] = bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 1}}
+	}
+	pipes[len(pipes)-1] = bson.M{"$project": project}
+	cursor, err := repo.Aggregate(ctx, pipes, aggregateOptions(opts))
+	if err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	type tileState struct {
+		count, points int
+		lng, lat      float64
+		values        hyperLogLog
+	}
+	tiles := make(map[string]*tileState)
+	for cursor.Next(ctx) {
+		var row struct {
+			Key   string   `bson:"key"`
+			Count int      `bson:"count"`
+			Lng   *float64 `bson:"lng"`
+			Lat   *float64 `bson:"lat"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		tile, ok := tiles[row.Key]
+		if !ok {
+			tile = &tileState{}
+			tiles[row.Key] = tile
+		}
+		tile.count += row.Count
+		if row.Lng != nil && row.Lat != nil {
+			tile.lng, tile.lat, tile.points = tile.lng+*row.Lng, tile.lat+*row.Lat, tile.points+1
+		}
+		if value := cursor.Current.Lookup("value"); value.Type != 0 {
+			tile.values.Add(append([]byte{byte(value.Type)}, value.Value...))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	rawRes := make([]RawStats, 0, len(tiles))
+	for key, tile := range tiles {
+		devices := tile.values.Count()
+		item := RawStats{ID: key, Count: tile.count, DeviceCount: &devices}
+		if tile.points > 0 {
+			lng, lat := tile.lng/float64(tile.points), tile.lat/float64(tile.points)
+			item.Lng, item.Lat = &lng, &lat
+		}
+		rawRes = append(rawRes, item)
+	}
+	sortStats(rawRes, order)
+	return filterMinCount(rawRes, floor), nil
+}
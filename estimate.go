@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SizeEstimate is the BSON size of the `levels` field measured on a sample
+// and extrapolated to the whole collection.
+type SizeEstimate struct {
+	Sampled   int
+	Documents int
+	Document  float64         // Average full document bytes
+	Levels    float64         // Average `levels` field bytes
+	ByZoom    map[int]float64 // Average `levels` array element bytes per zoom
+}
+
+// countDocuments counts the collection through an aggregation, xmongo has no
+// count helper.
+func countDocuments(ctx context.Context, repo RecordRepo) (int, error) {
+	cursor, err := repo.Aggregate(ctx, bson.A{bson.M{"$count": "n"}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var res struct {
+		N int `bson:"n"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&res); err != nil {
+			return 0, err
+		}
+	}
+	return res.N, cursor.Err()
+}
+
+// estimateSize marshals the levels of sample random documents with
+// bson.Marshal and averages their sizes.
+func estimateSize(ctx context.Context, repo RecordRepo, sample int) (SizeEstimate, error) {
+	total, err := countDocuments(ctx, repo)
+	if err != nil {
+		return SizeEstimate{}, err
+	}
+	cursor, err := repo.Aggregate(ctx, bson.A{bson.M{"$sample": bson.M{"size": sample}}})
+	if err != nil {
+		return SizeEstimate{}, err
+	}
+	defer cursor.Close(ctx)
+	estimate := SizeEstimate{Documents: total, ByZoom: make(map[int]float64)}
+	for cursor.Next(ctx) {
+		var record Record
+		if err := cursor.Decode(&record); err != nil {
+			return estimate, err
+		}
+		estimate.Sampled++
+		estimate.Document += float64(len(cursor.Current))
+		// An empty document is 5 bytes, the rest is the levels element.
+		levels, err := bson.Marshal(bson.D{{Key: "levels", Value: record.Levels}})
+		if err != nil {
+			return estimate, err
+		}
+		estimate.Levels += float64(len(levels) - 5)
+		for i, tile := range record.Levels {
+			element, err := bson.Marshal(tile)
+			if err != nil {
+				return estimate, err
+			}
+			// Type byte, array index key and its NUL, then the document.
+			estimate.ByZoom[int(tile.Z)] += float64(1 + len(strconv.Itoa(i)) + 1 + len(element))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return estimate, err
+	}
+	if estimate.Sampled > 0 {
+		n := float64(estimate.Sampled)
+		estimate.Document /= n
+		estimate.Levels /= n
+		for z := range estimate.ByZoom {
+			estimate.ByZoom[z] /= n
+		}
+	}
+	return estimate, nil
+}
+
+func estimateDemo(ctx context.Context, repo RecordRepo, sample int) {
+	estimate, err := estimateSize(ctx, repo, sample)
+	if err != nil {
+		panic(err)
+	}
+	docs := float64(estimate.Documents)
+	fmt.Printf("sampled %d of %d documents\n", estimate.Sampled, estimate.Documents)
+	fmt.Printf("document: %.0f bytes average, %.1f MB total\n", estimate.Document, estimate.Document*docs/1e6)
+	fmt.Printf("levels:   %.0f bytes average, %.1f MB total\n\n", estimate.Levels, estimate.Levels*docs/1e6)
+	zooms := make([]int, 0, len(estimate.ByZoom))
+	for z := range estimate.ByZoom {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "ZOOM\tBYTES/DOC\tTOTAL MB\tSHARE\t")
+	for _, z := range zooms {
+		size := estimate.ByZoom[z]
+		share := 0.0
+		if estimate.Levels > 0 {
+			share = size / estimate.Levels * 100
+		}
+		fmt.Fprintf(w, "%d\t%.0f\t%.1f\t%.1f%%\t\n", z, size, size*docs/1e6, share)
+	}
+	w.Flush()
+}
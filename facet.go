@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultFacetBoundaries are the -facet histogram bins without -count-bins,
+// by order of magnitude.
+var defaultFacetBoundaries = []int{1, 10, 100, 1000, 10000, 100000, 1000000}
+
+// FacetSummary is the combined result of -facet.
+type FacetSummary struct {
+	Level      int             `json:"level"`
+	Tiles      int             `json:"tiles"` // Non-empty tiles
+	Count      int             `json:"count"` // Sum of all tile counts
+	Top        GeoJSONFeatures `json:"top"`   // Tiles with the largest counts
+	Boundaries []int           `json:"boundaries"`
+	Histogram  []CountBin      `json:"histogram"`
+}
+
+type facetResult struct {
+	Top   []RawStats `bson:"top"`
+	Total []struct {
+		Tiles int `bson:"tiles"`
+		Count int `bson:"count"`
+	} `bson:"total"`
+	Histogram []CountBin `bson:"histogram"`
+}
+
+// facetCounts computes the top tiles, totals and a count histogram from a
+// single scan, a $facet after the grouping.
+//
+// $facet returns one document, so the whole output is bound by the 16MB
+// BSON limit, which top, as the only part growing with the data, keeps
+// far from. Its sub-pipelines get no indexes and each holds its input
+// within the 100MB stage memory limit, -allow-disk-use lifts that.
+func facetCounts(ctx context.Context, repo RecordRepo, level, top int, boundaries []int, opts Options) (FacetSummary, error) {
+	opts.Sort = ""
+	pipes := append(buildPipeline(level, opts), bson.M{
+		"$facet": bson.M{
+			"top": bson.A{
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": top},
+			},
+			"total": bson.A{
+				bson.M{"$group": bson.M{"_id": nil, "tiles": bson.M{"$sum": 1}, "count": bson.M{"$sum": "$count"}}},
+			},
+			"histogram": bson.A{
+				bson.M{"$bucket": bson.M{
+					"groupBy":    "$count",
+					"boundaries": boundaries,
+					"default":    "other",
+					"output":     bson.M{"tiles": bson.M{"$sum": 1}},
+				}},
+			},
+		},
+	})
+	cursor, err := repo.Aggregate(ctx, pipes, aggregateOptions(opts))
+	if err != nil {
+		return FacetSummary{}, fmt.Errorf("aggregate: %w", err)
+	}
+	res, err := xmongo.Decode[facetResult](ctx, cursor)
+	if err != nil {
+		return FacetSummary{}, fmt.Errorf("decode: %w", err)
+	}
+	summary := FacetSummary{Level: level, Boundaries: boundaries, Histogram: []CountBin{}}
+	if len(res) == 0 {
+		summary.Top = toFeatureCollection(nil, opts)
+		return summary, nil
+	}
+	expandKeys(res[0].Top)
+	summary.Top = toFeatureCollection(res[0].Top, opts)
+	if len(res[0].Total) > 0 {
+		summary.Tiles, summary.Count = res[0].Total[0].Tiles, res[0].Total[0].Count
+	}
+	if res[0].Histogram != nil {
+		summary.Histogram = res[0].Histogram
+	}
+	return summary, nil
+}
+
+func facetDemo(ctx context.Context, repo RecordRepo, level, top int, boundaries []int, opts Options) {
+	summary, err := facetCounts(ctx, repo, level, top, boundaries, opts)
+	if err != nil {
+		log.Panicln("Facet err", err.Error())
+	}
+	printJSON(summary, opts.Indent)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/paulmach/orb"
+)
+
+// FlatGeobuf is written with the flatbuffers builder directly, following
+// header.fbs and feature.fbs of the FlatGeobuf 3 spec, since there's no
+// published Go module for it.
+var fgbMagic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b', 0}
+
+const (
+	fgbGeometryUnknown = 0
+	fgbGeometryPoint   = 1
+	fgbGeometryPolygon = 3
+	fgbColumnLong      = 7
+	fgbColumnString    = 11
+	fgbNodeSize        = 16 // Packed Hilbert R-tree branching, the spec default
+	fgbNodeItemSize    = 40 // Four float64 bounds and a uint64 offset
+)
+
+// fgbFeature is an encoded feature and its bounds for the index.
+type fgbFeature struct {
+	bound orb.Bound
+	data  []byte
+}
+
+// writeFlatGeobuf writes rawRes as FlatGeobuf with key and count columns and
+// a packed Hilbert R-tree index, tile polygons with polygons and points with
+// -geometry placement otherwise.
+func writeFlatGeobuf(w io.Writer, rawRes []RawStats, opts Options, polygons bool) error {
+	geometryType := byte(fgbGeometryPoint)
+	if polygons {
+		geometryType = fgbGeometryPolygon
+	}
+	if !polygons && opts.Geometry == "hull" {
+		// Tiles without a hull, like single points, stay points, so features
+		// carry their own type.
+		geometryType = fgbGeometryUnknown
+	}
+	fc := toFeatureCollection(rawRes, opts)
+	features := make([]fgbFeature, len(rawRes))
+	extent := orb.Bound{}
+	for i, item := range rawRes {
+		geometry := statsGeometry(item, fc.Features[i], opts, polygons)
+		featureType := byte(fgbGeometryPoint)
+		if _, ok := geometry.(orb.Polygon); ok {
+			featureType = fgbGeometryPolygon
+		}
+		features[i] = fgbFeature{bound: geometry.Bound(), data: encodeFGBFeature(geometry, featureType, item)}
+		if i == 0 {
+			extent = features[i].bound
+		} else {
+			extent = extent.Union(features[i].bound)
+		}
+	}
+	hilbertSort(features, extent)
+
+	if _, err := w.Write(fgbMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(encodeFGBHeader(extent, geometryType, len(features))); err != nil {
+		return err
+	}
+	if len(features) == 0 {
+		return nil
+	}
+	if _, err := w.Write(packedRTree(features)); err != nil {
+		return err
+	}
+	for _, feature := range features {
+		if _, err := w.Write(feature.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizePrefixed finishes b and prepends the little-endian uint32 length.
+func sizePrefixed(b *flatbuffers.Builder, root flatbuffers.UOffsetT) []byte {
+	b.Finish(root)
+	data := b.FinishedBytes()
+	res := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(res, uint32(len(data)))
+	copy(res[4:], data)
+	return res
+}
+
+func encodeFGBHeader(extent orb.Bound, geometryType byte, count int) []byte {
+	b := flatbuffers.NewBuilder(1024)
+	name := b.CreateString(mvtLayerName)
+	columns := make([]flatbuffers.UOffsetT, 0, 2)
+	for _, column := range []struct {
+		name string
+		typ  byte
+	}{{"key", fgbColumnString}, {"count", fgbColumnLong}} {
+		columnName := b.CreateString(column.name)
+		b.StartObject(11)
+		b.PrependUOffsetTSlot(0, columnName, 0)
+		b.PrependByteSlot(1, column.typ, 0)
+		columns = append(columns, b.EndObject())
+	}
+	b.StartVector(4, len(columns), 4)
+	for i := len(columns) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(columns[i])
+	}
+	columnVector := b.EndVector(len(columns))
+	var envelope flatbuffers.UOffsetT
+	if count > 0 {
+		b.StartVector(8, 4, 8)
+		for _, v := range []float64{extent.Max.Lat(), extent.Max.Lon(), extent.Min.Lat(), extent.Min.Lon()} {
+			b.PrependFloat64(v)
+		}
+		envelope = b.EndVector(4)
+	}
+	org := b.CreateString("EPSG")
+	b.StartObject(6)
+	b.PrependUOffsetTSlot(0, org, 0)
+	b.PrependInt32Slot(1, 4326, 0)
+	crs := b.EndObject()
+
+	b.StartObject(14)
+	b.PrependUOffsetTSlot(0, name, 0)
+	b.PrependUOffsetTSlot(1, envelope, 0)
+	b.PrependByteSlot(2, geometryType, 0)
+	b.PrependUOffsetTSlot(7, columnVector, 0)
+	b.PrependUint64Slot(8, uint64(count), 0)
+	b.PrependUint16Slot(9, fgbNodeSize, 16)
+	b.PrependUOffsetTSlot(10, crs, 0)
+	return sizePrefixed(b, b.EndObject())
+}
+
+func encodeFGBFeature(geometry orb.Geometry, geometryType byte, item RawStats) []byte {
+	b := flatbuffers.NewBuilder(256)
+	var coordinates []orb.Point
+	var ends []uint32
+	switch g := geometry.(type) {
+	case orb.Point:
+		coordinates = []orb.Point{g}
+	case orb.Polygon:
+		for _, ring := range g {
+			coordinates = append(coordinates, ring...)
+			ends = append(ends, uint32(len(coordinates)))
+		}
+	}
+	var endsVector flatbuffers.UOffsetT
+	if len(ends) > 1 {
+		b.StartVector(4, len(ends), 4)
+		for i := len(ends) - 1; i >= 0; i-- {
+			b.PrependUint32(ends[i])
+		}
+		endsVector = b.EndVector(len(ends))
+	}
+	b.StartVector(8, 2*len(coordinates), 8)
+	for i := len(coordinates) - 1; i >= 0; i-- {
+		b.PrependFloat64(coordinates[i].Lat())
+		b.PrependFloat64(coordinates[i].Lon())
+	}
+	xy := b.EndVector(2 * len(coordinates))
+	b.StartObject(8)
+	b.PrependUOffsetTSlot(0, endsVector, 0)
+	b.PrependUOffsetTSlot(1, xy, 0)
+	b.PrependByteSlot(6, geometryType, 0)
+	geometryTable := b.EndObject()
+
+	// Properties are the column index as uint16 then the value, strings
+	// are prefixed by their uint32 length.
+	properties := make([]byte, 0, 2+4+len(item.ID)+2+8)
+	properties = appendUint16(properties, 0)
+	properties = appendUint32(properties, uint32(len(item.ID)))
+	properties = append(properties, item.ID...)
+	properties = appendUint16(properties, 1)
+	properties = appendUint64(properties, uint64(item.Count))
+	propertiesVector := b.CreateByteVector(properties)
+
+	b.StartObject(3)
+	b.PrependUOffsetTSlot(0, geometryTable, 0)
+	b.PrependUOffsetTSlot(1, propertiesVector, 0)
+	return sizePrefixed(b, b.EndObject())
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// hilbertSort orders features by the Hilbert curve value of their bound
+// centers within extent, as the index requires.
+func hilbertSort(features []fgbFeature, extent orb.Bound) {
+	const hilbertMax = 1<<16 - 1
+	width, height := extent.Max.Lon()-extent.Min.Lon(), extent.Max.Lat()-extent.Min.Lat()
+	values := make([]uint32, len(features))
+	for i, feature := range features {
+		var x, y uint32
+		if width > 0 {
+			x = uint32(math.Floor(hilbertMax * (feature.bound.Center().Lon() - extent.Min.Lon()) / width))
+		}
+		if height > 0 {
+			y = uint32(math.Floor(hilbertMax * (feature.bound.Center().Lat() - extent.Min.Lat()) / height))
+		}
+		values[i] = hilbert(x, y)
+	}
+	sort.Sort(byHilbert{features, values})
+}
+
+type byHilbert struct {
+	features []fgbFeature
+	values   []uint32
+}
+
+func (s byHilbert) Len() int           { return len(s.features) }
+func (s byHilbert) Less(i, j int) bool { return s.values[i] > s.values[j] }
+func (s byHilbert) Swap(i, j int) {
+	s.features[i], s.features[j] = s.features[j], s.features[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// hilbert maps 16 bit x and y to their position on the Hilbert curve, from
+// https://github.com/rawrunprotected/hilbert_curves as used by FlatGeobuf.
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a, b, c, d = A, B, C, D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
+
+// packedRTree builds the static index over features in file order, root
+// first and leaves last. Leaves point at byte offsets into the feature
+// data, parents at the node index of their first child.
+func packedRTree(features []fgbFeature) []byte {
+	levelSizes := []int{len(features)}
+	total := len(features)
+	for n := len(features); ; {
+		n = (n + fgbNodeSize - 1) / fgbNodeSize
+		total += n
+		levelSizes = append(levelSizes, n)
+		if n == 1 {
+			break
+		}
+	}
+	levelStarts := make([]int, len(levelSizes))
+	for i, end := 0, total; i < len(levelSizes); i++ {
+		levelStarts[i] = end - levelSizes[i]
+		end = levelStarts[i]
+	}
+
+	bounds := make([]orb.Bound, total)
+	offsets := make([]uint64, total)
+	var offset uint64
+	for i, feature := range features {
+		bounds[levelStarts[0]+i] = feature.bound
+		offsets[levelStarts[0]+i] = offset
+		offset += uint64(len(feature.data))
+	}
+	for level := 0; level < len(levelSizes)-1; level++ {
+		parent := levelStarts[level+1]
+		for pos, end := levelStarts[level], levelStarts[level]+levelSizes[level]; pos < end; parent++ {
+			bounds[parent], offsets[parent] = bounds[pos], uint64(pos)
+			for j := 0; j < fgbNodeSize && pos < end; j, pos = j+1, pos+1 {
+				bounds[parent] = bounds[parent].Union(bounds[pos])
+			}
+		}
+	}
+
+	res := make([]byte, 0, total*fgbNodeItemSize)
+	for i := range bounds {
+		for _, v := range []float64{bounds[i].Min.Lon(), bounds[i].Min.Lat(), bounds[i].Max.Lon(), bounds[i].Max.Lat()} {
+			res = appendUint64(res, math.Float64bits(v))
+		}
+		res = appendUint64(res, offsets[i])
+	}
+	return res
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/paulmach/orb"
+)
+
+// fgbTable reads the size prefixed flatbuffer at the start of data, returning
+// its root table and the bytes after it.
+func fgbTable(t *testing.T, data []byte) (*flatbuffers.Table, []byte) {
+	t.Helper()
+	if len(data) < 4 {
+		t.Fatalf("%d bytes left, expected a size prefix", len(data))
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 4+size {
+		t.Fatalf("flatbuffer of %d bytes past the end of the file", size)
+	}
+	buf := data[4 : 4+size]
+	return &flatbuffers.Table{Bytes: buf, Pos: flatbuffers.GetUOffsetT(buf)}, data[4+size:]
+}
+
+// fgbField is the vtable entry of the i-th field in the schema order.
+func fgbField(i int) flatbuffers.VOffsetT {
+	return flatbuffers.VOffsetT(4 + 2*i)
+}
+
+// fgbSlot is the offset of field i from the table start, zero if absent.
+func fgbSlot(table *flatbuffers.Table, i int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(table.Offset(fgbField(i)))
+}
+
+func fgbString(table *flatbuffers.Table, i int) string {
+	if o := fgbSlot(table, i); o != 0 {
+		return string(table.ByteVector(table.Pos + o))
+	}
+	return ""
+}
+
+func fgbSubTable(table *flatbuffers.Table, i int) *flatbuffers.Table {
+	o := fgbSlot(table, i)
+	if o == 0 {
+		return nil
+	}
+	return &flatbuffers.Table{Bytes: table.Bytes, Pos: table.Indirect(table.Pos + o)}
+}
+
+// fgbVector returns the start and length of vector field i.
+func fgbVector(table *flatbuffers.Table, i int) (flatbuffers.UOffsetT, int) {
+	o := fgbSlot(table, i)
+	if o == 0 {
+		return 0, 0
+	}
+	return table.Vector(o), table.VectorLen(o)
+}
+
+func fgbFloats(table *flatbuffers.Table, i int) []float64 {
+	start, n := fgbVector(table, i)
+	res := make([]float64, n)
+	for j := range res {
+		res[j] = table.GetFloat64(start + flatbuffers.UOffsetT(8*j))
+	}
+	return res
+}
+
+// TestFlatGeobufRoundTrip reads writeFlatGeobuf's output back following
+// header.fbs and feature.fbs and checks the header, the index and every
+// feature.
+func TestFlatGeobufRoundTrip(t *testing.T) {
+	stats := []RawStats{
+		{ID: "1205-1539-12", Count: 3},
+		{ID: "1206-1539-12", Count: 1},
+		{ID: "1190-1542-12", Count: 7},
+	}
+	for _, polygons := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := writeFlatGeobuf(&buf, stats, Options{}, polygons); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if !bytes.HasPrefix(data, fgbMagic) {
+			t.Fatalf("polygons %v: missing magic bytes", polygons)
+		}
+		header, rest := fgbTable(t, data[len(fgbMagic):])
+
+		wantType := byte(fgbGeometryPoint)
+		if polygons {
+			wantType = fgbGeometryPolygon
+		}
+		if got := header.GetByteSlot(fgbField(2), 0); got != wantType {
+			t.Errorf("polygons %v: geometry type %d, expected %d", polygons, got, wantType)
+		}
+		if got := header.GetUint64Slot(fgbField(8), 0); got != uint64(len(stats)) {
+			t.Errorf("polygons %v: features count %d, expected %d", polygons, got, len(stats))
+		}
+		nodeSize := int(header.GetUint16Slot(fgbField(9), 16))
+		if crs := fgbSubTable(header, 10); crs == nil || crs.GetInt32Slot(fgbField(1), 0) != 4326 {
+			t.Errorf("polygons %v: crs isn't EPSG:4326", polygons)
+		}
+		columnsStart, columnsLen := fgbVector(header, 7)
+		var columns []string
+		for i := 0; i < columnsLen; i++ {
+			column := &flatbuffers.Table{Bytes: header.Bytes, Pos: header.Indirect(columnsStart + flatbuffers.UOffsetT(4*i))}
+			columns = append(columns, fgbString(column, 0))
+		}
+		if len(columns) != 2 || columns[0] != "key" || columns[1] != "count" {
+			t.Fatalf("polygons %v: columns %v, expected [key count]", polygons, columns)
+		}
+		envelope := fgbFloats(header, 1)
+		if len(envelope) != 4 {
+			t.Fatalf("polygons %v: envelope %v", polygons, envelope)
+		}
+		extent := orb.Bound{Min: orb.Point{envelope[0], envelope[1]}, Max: orb.Point{envelope[2], envelope[3]}}
+
+		// The index size follows from the features count and node size.
+		nodes := len(stats)
+		for n := len(stats); n != 1; {
+			n = (n + nodeSize - 1) / nodeSize
+			nodes += n
+		}
+		if len(rest) < nodes*fgbNodeItemSize {
+			t.Fatalf("polygons %v: %d bytes left, expected an index of %d nodes", polygons, len(rest), nodes)
+		}
+		node := func(i int) (orb.Bound, uint64) {
+			item := rest[i*fgbNodeItemSize:]
+			v := func(j int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(item[8*j:])) }
+			return orb.Bound{Min: orb.Point{v(0), v(1)}, Max: orb.Point{v(2), v(3)}}, binary.LittleEndian.Uint64(item[32:])
+		}
+		if root, _ := node(0); root != extent {
+			t.Errorf("polygons %v: root node %v, expected the envelope %v", polygons, root, extent)
+		}
+		features := rest[nodes*fgbNodeItemSize:]
+
+		got := make(map[string]int)
+		for i := 0; i < len(stats); i++ {
+			leafBound, offset := node(nodes - len(stats) + i)
+			feature, _ := fgbTable(t, features[offset:])
+			geometry := fgbSubTable(feature, 0)
+			if geometry == nil {
+				t.Fatalf("polygons %v: feature %d has no geometry", polygons, i)
+			}
+			xy := fgbFloats(geometry, 1)
+			start, n := fgbVector(feature, 1)
+			properties := feature.Bytes[start : int(start)+n]
+			if binary.LittleEndian.Uint16(properties) != 0 {
+				t.Fatalf("polygons %v: feature %d doesn't start with the key column", polygons, i)
+			}
+			keyLen := int(binary.LittleEndian.Uint32(properties[2:]))
+			key := string(properties[6 : 6+keyLen])
+			properties = properties[6+keyLen:]
+			if binary.LittleEndian.Uint16(properties) != 1 {
+				t.Fatalf("polygons %v: feature %s doesn't have the count column next", polygons, key)
+			}
+			got[key] = int(binary.LittleEndian.Uint64(properties[2:]))
+
+			tile, err := ParseTileKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bound := orb.Bound{Min: orb.Point{xy[0], xy[1]}, Max: orb.Point{xy[0], xy[1]}}
+			for j := 2; j+1 < len(xy); j += 2 {
+				bound = bound.Extend(orb.Point{xy[j], xy[j+1]})
+			}
+			if bound != leafBound {
+				t.Errorf("polygons %v: %s leaf node %v, expected the geometry bound %v", polygons, key, leafBound, bound)
+			}
+			if polygons && (len(xy) != 10 || bound != projection.Bound(tile)) {
+				t.Errorf("polygons %v: %s polygon %v, expected the tile bound %v", polygons, key, xy, projection.Bound(tile))
+			}
+			if !polygons && (len(xy) != 2 || !projection.Bound(tile).Contains(orb.Point{xy[0], xy[1]})) {
+				t.Errorf("polygons %v: %s point %v outside its tile", polygons, key, xy)
+			}
+		}
+		for _, item := range stats {
+			if got[item.ID] != item.Count {
+				t.Errorf("polygons %v: %s count %d, expected %d", polygons, item.ID, got[item.ID], item.Count)
+			}
+		}
+	}
+}
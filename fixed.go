@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+)
+
+// FixedLayout holds the [start, end) byte ranges of the fields of a
+// fixed-width file.
+type FixedLayout struct {
+	Lat, Lng [2]int
+}
+
+// parseFixedLayout parses `lat=0:10,lng=10:21`.
+func parseFixedLayout(raw string) (FixedLayout, error) {
+	var layout FixedLayout
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		name, span, ok := strings.Cut(strings.TrimSpace(part), "=")
+		start, end, ok2 := strings.Cut(span, ":")
+		if !ok || !ok2 {
+			return layout, fmt.Errorf("field must be name=start:end, got %q", part)
+		}
+		from, err := strconv.Atoi(start)
+		if err != nil {
+			return layout, fmt.Errorf("invalid start %q", start)
+		}
+		to, err := strconv.Atoi(end)
+		if err != nil {
+			return layout, fmt.Errorf("invalid end %q", end)
+		}
+		if from < 0 || to <= from {
+			return layout, fmt.Errorf("range %q must have 0 <= start < end", span)
+		}
+		switch name {
+		case "lat":
+			layout.Lat = [2]int{from, to}
+		case "lng":
+			layout.Lng = [2]int{from, to}
+		default:
+			return layout, fmt.Errorf("unknown field %q, use lat and lng", name)
+		}
+		seen[name] = true
+	}
+	if !seen["lat"] || !seen["lng"] {
+		return layout, fmt.Errorf("need both lat and lng ranges, got %q", raw)
+	}
+	return layout, nil
+}
+
+// ParseFixed reads a fixed-width file without header, slicing each line by
+// layout. Slices are trimmed and parsed like CSV coordinates, short or
+// unparsable lines are bad rows.
+func ParseFixed(r io.Reader, layout FixedLayout, opts ParseOptions) (records []Record, failed int, err error) {
+	scanner := bufio.NewScanner(r)
+	ret := make([]Record, 0)
+	for index := 0; scanner.Scan(); index++ {
+		if opts.Limit > 0 && len(ret) >= opts.Limit {
+			break
+		}
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		record, err := fixedRecord(line, layout, opts)
+		if err != nil {
+			if err := opts.reject("line", index+1, line, err); err != nil {
+				return nil, failed, err
+			}
+			failed++
+			continue
+		}
+		record.SourceKey = RowKey(index, line)
+		record.Row = index + 1
+		opts.setID(&record)
+		ret = append(ret, record)
+	}
+	return ret, failed, scanner.Err()
+}
+
+// fixedRecord converts one fixed-width line.
+func fixedRecord(line string, layout FixedLayout, opts ParseOptions) (Record, error) {
+	lat, err := fixedField("lat", line, layout.Lat, opts)
+	if err != nil {
+		return Record{}, err
+	}
+	lng, err := fixedField("lng", line, layout.Lng, opts)
+	if err != nil {
+		return Record{}, err
+	}
+	point := orb.Point{lng, lat}
+	if err := validatePoint(point, opts.ValidateCoordinates); err != nil {
+		return Record{}, err
+	}
+	return newRecord(point, opts), nil
+}
+
+// fixedField parses the coordinate field in line's span.
+func fixedField(field, line string, span [2]int, opts ParseOptions) (float64, error) {
+	if len(line) < span[1] {
+		return 0, fmt.Errorf("line has %d bytes, field ends at %d", len(line), span[1])
+	}
+	return parseCoordinate(field, line[span[0]:span[1]], opts)
+}
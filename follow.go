@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+)
+
+// followTop is how many tiles -follow shows.
+const followTop = 20
+
+func printTopTiles(stats []RawStats, level int) {
+	sortStats(stats, "count")
+	if len(stats) > followTop {
+		stats = stats[:followTop]
+	}
+	fmt.Print("\033[H\033[2J") // Clear the terminal
+	fmt.Printf("top tiles at level %d, %s\n\n", level, time.Now().Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tTILE\tCOUNT")
+	for i, item := range stats {
+		fmt.Fprintf(w, "%d\t%s\t%d\n", i+1, item.ID, item.Count)
+	}
+	w.Flush()
+}
+
+// follow re-runs the aggregation every interval and prints the top tiles,
+// until interrupted.
+func follow(repo RecordRepo, level int, interval time.Duration, opts Options) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		stats, err := aggregate(runCtx, repo, level, opts)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		printTopTiles(stats, level)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
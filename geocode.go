@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+)
+
+// Geocoder resolves a free-form query such as an address to a point.
+type Geocoder interface {
+	Geocode(ctx context.Context, query string) (orb.Point, error)
+}
+
+// StubGeocoder is the default Geocoder, it only understands literal
+// `lng,lat` queries. Plug in a real implementation for address lookups.
+type StubGeocoder struct{}
+
+func (StubGeocoder) Geocode(ctx context.Context, query string) (orb.Point, error) {
+	parts := strings.Split(query, ",")
+	if len(parts) != 2 {
+		return orb.Point{}, errors.New("stub geocoder only accepts lng,lat, configure a Geocoder for addresses")
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid lng in %q", query)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid lat in %q", query)
+	}
+	return orb.Point{lng, lat}, nil
+}
+
+type locatedLevel struct {
+	Z   uint32 `json:"z"`
+	Key string `json:"key"`
+}
+
+type locateResult struct {
+	Query    string         `json:"query"`
+	Location GeoPoint       `json:"location"`
+	Levels   []locatedLevel `json:"levels"`
+}
+
+// locate geocodes query and returns its tile key at every indexed level.
+func locate(ctx context.Context, geocoder Geocoder, query string) (locateResult, error) {
+	point, err := geocoder.Geocode(ctx, query)
+	if err != nil {
+		return locateResult{}, fmt.Errorf("geocode %q: %w", query, err)
+	}
+	record := Record{Location: GeoPoint{Type: "Point", Coordinates: []float64{point.Lon(), point.Lat()}}}
+	record.SetLevels()
+	res := locateResult{Query: query, Location: record.Location}
+	for _, tile := range record.Levels {
+		res.Levels = append(res.Levels, locatedLevel{Z: tile.Z, Key: tile.Key})
+	}
+	return res, nil
+}
+
+func locateDemo(ctx context.Context, geocoder Geocoder, query string, opts Options) {
+	res, err := locate(ctx, geocoder, query)
+	if err != nil {
+		panic(err)
+	}
+	printJSON(res, opts.Indent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// propertyTypes are the types a RequiredProperty can check, as decoded from
+// JSON.
+var propertyTypes = map[string]func(v interface{}) bool{
+	"": func(v interface{}) bool { return true },
+	"string": func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	},
+	"number": func(v interface{}) bool {
+		_, ok := v.(float64)
+		return ok
+	},
+	"bool": func(v interface{}) bool {
+		_, ok := v.(bool)
+		return ok
+	},
+}
+
+// RequiredProperty is a property a GeoJSON feature must have, with an
+// optional type from propertyTypes.
+type RequiredProperty struct {
+	Name string
+	Type string
+}
+
+// RequiredProperties implements flag.Value for repeatable `-require-prop`.
+type RequiredProperties []RequiredProperty
+
+func (p *RequiredProperties) String() string {
+	parts := make([]string, len(*p))
+	for i, prop := range *p {
+		parts[i] = prop.Name
+		if prop.Type != "" {
+			parts[i] += ":" + prop.Type
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *RequiredProperties) Set(raw string) error {
+	name, typ, _ := strings.Cut(raw, ":")
+	if name == "" {
+		return fmt.Errorf("required property needs a name, got %q", raw)
+	}
+	if _, ok := propertyTypes[typ]; !ok {
+		return fmt.Errorf("unknown property type %q, use string, number or bool", typ)
+	}
+	*p = append(*p, RequiredProperty{Name: name, Type: typ})
+	return nil
+}
+
+// missingProperty returns why properties fail the requirements, empty if
+// they pass.
+func missingProperty(properties geojson.Properties, required RequiredProperties) string {
+	for _, prop := range required {
+		v, ok := properties[prop.Name]
+		if !ok {
+			return "missing " + prop.Name
+		}
+		if !propertyTypes[prop.Type](v) {
+			return fmt.Sprintf("%s is not a %s", prop.Name, prop.Type)
+		}
+	}
+	return ""
+}
+
+// skipReason groups err for the skipped features summary, coordinates by
+// field and reason rather than value.
+func skipReason(err error) string {
+	var coordErr *CoordinateError
+	if errors.As(err, &coordErr) {
+		return coordErr.Field + " " + coordErr.Reason
+	}
+	return err.Error()
+}
+
+// ParseGeoJSON reads the Point features of a FeatureCollection, keeping
+// their properties. Other geometries and features failing the required
+// properties are skipped, counted, and summarized in the log.
+func ParseGeoJSON(r io.Reader, opts ParseOptions) (records []Record, failed int, err error) {
+	var fc geojson.FeatureCollection
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, 0, fmt.Errorf("decode geojson: %w", err)
+	}
+	skipped := make(map[string]int)
+	ret := make([]Record, 0, len(fc.Features))
+	for index, feature := range fc.Features {
+		if opts.Limit > 0 && len(ret) >= opts.Limit {
+			break
+		}
+		var reason error
+		point, ok := feature.Geometry.(orb.Point)
+		if !ok {
+			reason = errors.New("not a point")
+		} else if err := validatePoint(point, opts.ValidateCoordinates); err != nil {
+			reason = err
+		} else if missing := missingProperty(feature.Properties, opts.RequiredProperties); missing != "" {
+			reason = errors.New(missing)
+		}
+		if reason != nil {
+			if err := opts.reject("feature", index, "", reason); err != nil {
+				return nil, failed, err
+			}
+			skipped[skipReason(reason)]++
+			continue
+		}
+		record := newRecord(point, opts)
+		record.Properties = feature.Properties
+		record.Row = index
+		content, _ := json.Marshal(feature)
+		record.SourceKey = RowKey(index, string(content))
+		opts.setID(&record)
+		if opts.TimeColumn != "" {
+			raw, _ := feature.Properties[opts.TimeColumn].(string)
+			timestamp, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				reason := "invalid " + opts.TimeColumn
+				if err := opts.reject("feature", index, "", errors.New(reason)); err != nil {
+					return nil, failed, err
+				}
+				skipped[reason]++
+				continue
+			}
+			record.Timestamp = &timestamp
+		}
+		ret = append(ret, record)
+	}
+	for reason, count := range skipped {
+		log.Printf("skipped %d features: %s", count, reason)
+		failed += count
+	}
+	return ret, failed, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// formats are the valid -format values.
+var formats = map[string]bool{
+	"geojson":    true,
+	"geoparquet": true, // GeoParquet 1.0, WKB geometry in the `geometry` column
+	"fgb":        true, // FlatGeobuf 3 with a packed Hilbert R-tree index
+	"ndjson":     true, // One GeoJSON Feature per line
+	"mbtiles":    true, // MBTiles 1.3 SQLite file of gzipped MVT, with -out
+}
+
+// parquetTile is one GeoParquet row, Geometry holds WKB.
+type parquetTile struct {
+	Key      string `parquet:"name=key, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Count    int64  `parquet:"name=count, type=INT64"`
+	Geometry string `parquet:"name=geometry, type=BYTE_ARRAY"`
+}
+
+// geoMetadata is the `geo` file metadata of the GeoParquet convention, CRS
+// is omitted which means OGC:CRS84 longitude, latitude.
+type geoMetadata struct {
+	Version       string                       `json:"version"`
+	PrimaryColumn string                       `json:"primary_column"`
+	Columns       map[string]geoColumnMetadata `json:"columns"`
+}
+
+type geoColumnMetadata struct {
+	Encoding      string    `json:"encoding"`
+	GeometryTypes []string  `json:"geometry_types"`
+	BBox          []float64 `json:"bbox,omitempty"`
+}
+
+// statsGeometry is the tile, or grid cell, polygon with polygons and the
+// feature hull or point otherwise.
+func statsGeometry(item RawStats, feature GeoJSONFeatureItem, opts Options, polygons bool) orb.Geometry {
+	if !polygons && opts.Geometry == "hull" {
+		if hull, ok := convexHull(item.Points); ok {
+			return hull
+		}
+	}
+	if !polygons {
+		return orb.Point{feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1]}
+	}
+	if opts.GridSize > 0 {
+		_, bound, _ := ParseGridKey(item.ID)
+		return bound.ToPolygon()
+	}
+	tile, _ := ParseTileKey(item.ID)
+	return projection.Bound(tile).ToPolygon()
+}
+
+// writeGeoParquet writes rawRes as GeoParquet with key, count and a WKB
+// geometry column, tile polygons with polygons and points with -geometry
+// placement otherwise.
+func writeGeoParquet(w io.Writer, rawRes []RawStats, opts Options, polygons bool) error {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetTile), 1)
+	if err != nil {
+		return err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	fc := toFeatureCollection(rawRes, opts)
+	bound := orb.Bound{}
+	for i, item := range rawRes {
+		geometry := statsGeometry(item, fc.Features[i], opts, polygons)
+		if i == 0 {
+			bound = geometry.Bound()
+		} else {
+			bound = bound.Union(geometry.Bound())
+		}
+		content, err := wkb.Marshal(geometry)
+		if err != nil {
+			return err
+		}
+		if err := pw.Write(parquetTile{Key: item.ID, Count: int64(item.Count), Geometry: string(content)}); err != nil {
+			return fmt.Errorf("write row %s: %w", item.ID, err)
+		}
+	}
+	geometryType := "Point"
+	if polygons {
+		geometryType = "Polygon"
+	}
+	column := geoColumnMetadata{Encoding: "WKB", GeometryTypes: []string{geometryType}}
+	if len(rawRes) > 0 {
+		column.BBox = []float64{bound.Min.Lon(), bound.Min.Lat(), bound.Max.Lon(), bound.Max.Lat()}
+	}
+	metadata, err := json.Marshal(geoMetadata{
+		Version:       "1.0.0",
+		PrimaryColumn: "geometry",
+		Columns:       map[string]geoColumnMetadata{"geometry": column},
+	})
+	if err != nil {
+		return err
+	}
+	value := string(metadata)
+	pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{Key: "geo", Value: &value})
+	return pw.WriteStop()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+// metersPerDegree is the length of a degree of latitude, and of longitude
+// at the equator, on the WGS84 ellipsoid's approximation used here.
+const metersPerDegree = 111320.0
+
+// GridCell is a cell of a regular grid of roughly Size x Size meters. Rows
+// are fixed latitude bands, and each row's longitude step is widened by
+// 1/cos(lat) so cells stay about square in meters.
+type GridCell struct {
+	Size float64 `bson:"size"` // Cell size in meters
+	Key  string  `bson:"key"`  // `size-col-row`
+}
+
+func gridSteps(size float64, row int) (latStep, lngStep float64) {
+	latStep = size / metersPerDegree
+	centerLat := -90 + (float64(row)+0.5)*latStep
+	lngStep = size / (metersPerDegree * math.Max(math.Cos(centerLat*math.Pi/180), 1e-6))
+	return latStep, lngStep
+}
+
+// GridCellAt returns the cell of a size meters grid containing point.
+func GridCellAt(point orb.Point, size float64) GridCell {
+	row := int(math.Floor((point.Lat() + 90) / (size / metersPerDegree)))
+	_, lngStep := gridSteps(size, row)
+	col := int(math.Floor((point.Lon() + 180) / lngStep))
+	return GridCell{Size: size, Key: fmt.Sprintf("%v-%v-%v", size, col, row)}
+}
+
+// ParseGridKey returns the bound of a cell from its `size-col-row` key.
+func ParseGridKey(key string) (size float64, bound orb.Bound, err error) {
+	var col, row int
+	if _, err := fmt.Sscanf(key, "%g-%d-%d", &size, &col, &row); err != nil {
+		return 0, orb.Bound{}, fmt.Errorf("invalid grid key %q: %w", key, err)
+	}
+	latStep, lngStep := gridSteps(size, row)
+	min := orb.Point{-180 + float64(col)*lngStep, -90 + float64(row)*latStep}
+	return size, orb.Bound{Min: min, Max: orb.Point{min.Lon() + lngStep, min.Lat() + latStep}}, nil
+}
+
+func FromGridStatsToGeoJSONFeatureItem(raw RawStats) GeoJSONFeatureItem {
+	size, bound, _ := ParseGridKey(raw.ID)
+	center := bound.Center()
+	return GeoJSONFeatureItem{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"count":    raw.Count,
+			"gridKey":  raw.ID,
+			"cellSize": size,
+			"cellBbox": []float64{bound.Min.Lon(), bound.Min.Lat(), bound.Max.Lon(), bound.Max.Lat()},
+		},
+		Geometry: GeoPoint{
+			Type:        "Point",
+			Coordinates: []float64{center.Lon(), center.Lat()},
+		},
+	}
+}
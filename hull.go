@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+)
+
+// convexHull returns the counter-clockwise convex hull of points by
+// Andrew's monotone chain, orb has none. It's false for fewer than 3
+// distinct points or collinear ones, whose hull has no area.
+func convexHull(points [][]float64) (orb.Polygon, bool) {
+	sorted := make([]orb.Point, 0, len(points))
+	for _, p := range points {
+		if len(p) >= 2 {
+			sorted = append(sorted, orb.Point{p[0], p[1]})
+		}
+	}
+	if len(sorted) < 3 {
+		return nil, false
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i][0] != sorted[j][0] {
+			return sorted[i][0] < sorted[j][0]
+		}
+		return sorted[i][1] < sorted[j][1]
+	})
+	cross := func(o, a, b orb.Point) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+	hull := make(orb.Ring, 0, len(sorted)+1)
+	// Lower chain left to right, then upper chain back, dropping right turns.
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for i := range sorted {
+			p := sorted[i]
+			if pass == 1 {
+				p = sorted[len(sorted)-1-i]
+			}
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1]
+	}
+	hull = append(hull, hull[0])
+	if len(hull) < 4 || planar.Area(hull) == 0 {
+		return nil, false
+	}
+	return orb.Polygon{hull}, true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// Indexer assigns points the keys Record.Levels stores and groups on, and
+// turns keys back into shapes for output. Alternative schemes like H3, S2
+// or geohash implement it to reuse the pipeline.
+type Indexer interface {
+	// Index returns one key per level, from minZoom to maxZoom.
+	Index(point orb.Point) []string
+	// Decode returns the center and footprint of a key, a zero center
+	// and nil geometry if the key is invalid.
+	Decode(key string) (center orb.Point, geometry orb.Geometry)
+}
+
+// MaptileIndexer keys points by the `x-y-z` tile of projection containing
+// them at each level.
+type MaptileIndexer struct{}
+
+func (MaptileIndexer) Index(point orb.Point) []string {
+	keys := make([]string, 0, maxZoom-minZoom+1)
+	for z := minZoom; z <= maxZoom; z++ {
+		keys = append(keys, TileKey(projection.At(point, maptile.Zoom(z))))
+	}
+	return keys
+}
+
+func (MaptileIndexer) Decode(key string) (orb.Point, orb.Geometry) {
+	tile, err := ParseTileKey(key)
+	if err != nil {
+		return orb.Point{}, nil
+	}
+	return projection.Center(tile), projection.Bound(tile).ToPolygon()
+}
+
+// indexer is used by SetLevels and the GeoJSON conversion, replace it
+// before parsing input to change the scheme.
+var indexer Indexer = MaptileIndexer{}
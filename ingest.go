@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/paulmach/orb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// InsertRecord builds a Record for point, with its levels, and inserts it
+// for streaming sources pushing one point at a time. It's safe to call from
+// many goroutines: opts.Timings is ignored since it isn't synchronized, and
+// the driver's collection and connection pool are concurrency safe. There's
+// no stored rollup to update, coarser levels are aggregated from the same
+// document's levels. Unlike a bare point, opts is taken so streamed records
+// get the -grid-size cell, -dataset and -tile-geometry of parsed ones.
+func InsertRecord(ctx context.Context, repo RecordRepo, point orb.Point, opts ParseOptions) (primitive.ObjectID, error) {
+	if point.Lon() < -180 || point.Lon() > 180 || point.Lat() < -90 || point.Lat() > 90 {
+		return primitive.NilObjectID, fmt.Errorf("point %v out of range", point)
+	}
+	opts.Timings = nil
+	record := newRecord(point, opts)
+	if _, err := repo.InsertOne(ctx, record); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("insert: %w", err)
+	}
+	return record.ID, nil
+}
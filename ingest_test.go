@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestInsertRecordConcurrent inserts points from many goroutines, run it
+// with -race, and checks every record got its own ID and is aggregated into
+// the tile its point falls in at every level.
+func TestInsertRecordConcurrent(t *testing.T) {
+	const workers, perWorker = 8, 50
+	rnd := rand.New(rand.NewSource(1))
+	points := make([]orb.Point, workers*perWorker)
+	for i := range points {
+		points[i] = orb.Point{-74.05 + rnd.Float64()*0.2, 40.65 + rnd.Float64()*0.2}
+	}
+	repo, err := NewMemoryRepo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shared, InsertRecord must not touch it.
+	opts := ParseOptions{Timings: &Timings{}}
+	ids := make([]primitive.ObjectID, len(points))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * perWorker; i < (w+1)*perWorker; i++ {
+				if ids[i], errs[w] = InsertRecord(context.Background(), repo, points[i], opts); errs[w] != nil {
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		if id.IsZero() || seen[id] {
+			t.Fatalf("ID %v is zero or repeated", id)
+		}
+		seen[id] = true
+	}
+	for level := minZoom; level <= maxZoom; level++ {
+		want := make(map[string]int)
+		for _, point := range points {
+			want[TileKey(projection.At(point, maptile.Zoom(level)))]++
+		}
+		stats, err := aggregate(context.Background(), repo, level, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != len(want) {
+			t.Errorf("level %d: %d tiles, expected %d", level, len(stats), len(want))
+		}
+		for _, item := range stats {
+			if item.Count != want[item.ID] {
+				t.Errorf("level %d tile %s: count %d, expected %d", level, item.ID, item.Count, want[item.ID])
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/maptile"
+)
+
+// tileAreaKM2 is the tile's area on the sphere in square kilometers.
+func tileAreaKM2(tile maptile.Tile) float64 {
+	return geo.Area(projection.Bound(tile).ToPolygon()) / 1e6
+}
+
+// InterpolateZoom blends densities between the two integer levels around a
+// fractional zoom, e.g. 10.4 weights z=10 by 0.6 and z=11 by 0.4.
+//
+// It's an approximation for smooth zoom rendering: both queries still snap
+// to the stored integer levels, and the coarse density is spread evenly over
+// its children. Features are emitted on the finer grid with a `density`
+// property in count per km².
+func InterpolateZoom(ctx context.Context, repo RecordRepo, zoom float64, opts Options) (GeoJSONFeatures, error) {
+	if zoom < float64(minZoom) || zoom > float64(maxZoom) {
+		return GeoJSONFeatures{}, fmt.Errorf("zoom %v out of range [%d, %d]", zoom, minZoom, maxZoom)
+	}
+	low := int(math.Floor(zoom))
+	weight := zoom - float64(low)
+	if low == maxZoom {
+		low, weight = maxZoom-1, 1
+	}
+	// Children of the coarse tiles are looked up one stored zoom finer.
+	if storedZoom(low, opts) == storedZoom(low+1, opts) {
+		return GeoJSONFeatures{}, fmt.Errorf("zooms %d and %d are both stored at zoom %d with -zoom-offset %d, nothing to blend", low, low+1, storedZoom(low, opts), opts.ZoomOffset)
+	}
+
+	coarse, err := aggregate(ctx, repo, low, opts)
+	if err != nil {
+		return GeoJSONFeatures{}, err
+	}
+	fine, err := aggregate(ctx, repo, low+1, opts)
+	if err != nil {
+		return GeoJSONFeatures{}, err
+	}
+	fineCounts := make(map[string]int, len(fine))
+	for _, item := range fine {
+		fineCounts[item.ID] = item.Count
+	}
+
+	stats := make([]RawStats, 0, len(fine))
+	densities := make([]float64, 0, len(fine))
+	for _, item := range coarse {
+		parent, err := ParseTileKey(item.ID)
+		if err != nil {
+			return GeoJSONFeatures{}, err
+		}
+		parentDensity := float64(item.Count) / tileAreaKM2(parent)
+		for _, child := range parent.Children() {
+			key := TileKey(child)
+			childDensity := float64(fineCounts[key]) / tileAreaKM2(child)
+			stats = append(stats, RawStats{ID: key, Count: fineCounts[key]})
+			densities = append(densities, (1-weight)*parentDensity+weight*childDensity)
+		}
+	}
+
+	keep := opts.OutputProperties
+	opts.OutputProperties = nil
+	res := toFeatureCollection(stats, opts)
+	for index := range res.Features {
+		res.Features[index].Properties["density"] = densities[index]
+	}
+	selectProperties(res.Features, keep)
+	return res, nil
+}
+
+func blendDemo(ctx context.Context, repo RecordRepo, zoom float64, opts Options) {
+	finalRes, err := InterpolateZoom(ctx, repo, zoom, opts)
+	if err != nil {
+		log.Panicln("Interpolate err", err.Error())
+	}
+	printJSON(finalRes, opts.Indent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// spreadKernel spreads every tile's count over itself and its 8 neighbors
+// with a Gaussian of bandwidth tile widths around the tile's centroid,
+// setting RawStats.Kernel. Neighbors without records are added with a zero
+// count, each tile's weights sum to its count so totals are kept.
+//
+// It's an approximation for smoother heatmaps done after the aggregation:
+// all points of a tile spread from their centroid, not individually, and
+// nothing reaches past the immediate neighbors, which a bandwidth over
+// about half a tile would.
+func spreadKernel(rawRes []RawStats, level int, bandwidth float64, opts Options) ([]RawStats, error) {
+	weights := make(map[string]float64, len(rawRes))
+	index := make(map[string]int, len(rawRes))
+	for i, item := range rawRes {
+		index[item.ID] = i
+	}
+	z := maptile.Zoom(level)
+	n := int64(1) << z
+	for _, item := range rawRes {
+		tile, err := ParseTileKey(item.ID)
+		if err != nil {
+			return nil, err
+		}
+		// The centroid in tile widths from the tile's top left corner,
+		// linear in latitude which is close enough within a tile.
+		u, v := 0.5, 0.5
+		if item.Lng != nil && item.Lat != nil {
+			bound := projection.Bound(tile)
+			u = (*item.Lng - bound.Min.Lon()) / (bound.Max.Lon() - bound.Min.Lon())
+			v = (bound.Max.Lat() - *item.Lat) / (bound.Max.Lat() - bound.Min.Lat())
+		}
+		neighbors := make([]maptile.Tile, 0, 9)
+		kernel := make([]float64, 0, 9)
+		sum := 0.0
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				x, y := int64(tile.X)+int64(dx), int64(tile.Y)+int64(dy)
+				if x < 0 || y < 0 || x >= n || y >= n {
+					continue
+				}
+				du, dv := u-(float64(dx)+0.5), v-(float64(dy)+0.5)
+				w := math.Exp(-(du*du + dv*dv) / (2 * bandwidth * bandwidth))
+				neighbors = append(neighbors, maptile.New(uint32(x), uint32(y), z))
+				kernel = append(kernel, w)
+				sum += w
+			}
+		}
+		for i, neighbor := range neighbors {
+			weights[TileKey(neighbor)] += float64(item.Count) * kernel[i] / sum
+		}
+	}
+	for key := range weights {
+		if _, ok := index[key]; !ok {
+			index[key] = len(rawRes)
+			rawRes = append(rawRes, RawStats{ID: key})
+		}
+	}
+	for key, weight := range weights {
+		weight := weight
+		item := &rawRes[index[key]]
+		item.Kernel = &weight
+		if opts.Geometry != "centroid" {
+			// Only collected for the spreading, the feature stays at the
+			// tile center.
+			item.Lng, item.Lat = nil, nil
+		}
+	}
+	sortStats(rawRes, opts.Sort)
+	return rawRes, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// keyFormats are the valid -key-format values, the indexer storing each.
+var keyFormats = map[string]Indexer{
+	"xyz":    MaptileIndexer{}, // `x-y-z`, readable, up to 12 bytes at maxZoom
+	"base62": CompactIndexer{}, // Packed x, y and z in base62, up to 6 bytes at maxZoom
+}
+
+// CompactTileKey packs z in the low 5 bits, then x and y in z bits each,
+// and writes the integer in base62.
+func CompactTileKey(tile maptile.Tile) string {
+	v := uint64(tile.Z) | uint64(tile.X)<<5 | uint64(tile.Y)<<(5+uint(tile.Z))
+	if v == 0 {
+		return base62Alphabet[:1]
+	}
+	var buf [11]byte
+	i := len(buf)
+	for ; v > 0; v /= 62 {
+		i--
+		buf[i] = base62Alphabet[v%62]
+	}
+	return string(buf[i:])
+}
+
+// ParseCompactTileKey parses a key built by CompactTileKey.
+func ParseCompactTileKey(key string) (maptile.Tile, error) {
+	if key == "" || len(key) > 11 {
+		return maptile.Tile{}, fmt.Errorf("invalid compact tile key %q", key)
+	}
+	var v uint64
+	for _, c := range key {
+		digit := strings.IndexRune(base62Alphabet, c)
+		if digit < 0 {
+			return maptile.Tile{}, fmt.Errorf("invalid compact tile key %q", key)
+		}
+		v = v*62 + uint64(digit)
+	}
+	z := uint(v & 31)
+	tile := maptile.New(uint32(v>>5&(1<<z-1)), uint32(v>>(5+z)), maptile.Zoom(z))
+	if uint64(tile.Y) >= 1<<z || CompactTileKey(tile) != key {
+		return maptile.Tile{}, fmt.Errorf("invalid compact tile key %q", key)
+	}
+	return tile, nil
+}
+
+// CompactIndexer is MaptileIndexer with CompactTileKey keys, they're shorter
+// in documents and the levels index at the cost of readability.
+type CompactIndexer struct{}
+
+func (CompactIndexer) Index(point orb.Point) []string {
+	keys := make([]string, 0, maxZoom-minZoom+1)
+	for z := minZoom; z <= maxZoom; z++ {
+		keys = append(keys, CompactTileKey(projection.At(point, maptile.Zoom(z))))
+	}
+	return keys
+}
+
+func (CompactIndexer) Decode(key string) (orb.Point, orb.Geometry) {
+	return MaptileIndexer{}.Decode(key)
+}
+
+// storedKey converts an `x-y-z` key to the form indexer stores, for
+// matching against `levels.key`.
+func storedKey(key string) string {
+	if _, ok := indexer.(CompactIndexer); !ok {
+		return key
+	}
+	tile, err := ParseTileKey(key)
+	if err != nil {
+		return key
+	}
+	return CompactTileKey(tile)
+}
+
+// storedKeys is storedKey for a list of keys.
+func storedKeys(keys bson.A) bson.A {
+	res := make(bson.A, len(keys))
+	for i, key := range keys {
+		res[i] = storedKey(key.(string))
+	}
+	return res
+}
+
+// expandKey rewrites a compact key of aggregation output to `x-y-z`, so
+// everything after the aggregation sees one format. Other keys are kept.
+func expandKey(key string) string {
+	if tile, err := ParseCompactTileKey(key); err == nil {
+		return TileKey(tile)
+	}
+	return key
+}
+
+// expandKeys is expandKey for aggregation output.
+func expandKeys(rawRes []RawStats) {
+	if _, ok := indexer.(CompactIndexer); !ok {
+		return
+	}
+	for i := range rawRes {
+		rawRes[i].ID = expandKey(rawRes[i].ID)
+	}
+}
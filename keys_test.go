@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+// TestKeyRoundTrip runs CheckKeyRoundTrip on random points.
+func TestKeyRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		point := orb.Point{rnd.Float64()*360 - 180, (rnd.Float64()*2 - 1) * maxMercatorLat}
+		if err := CheckKeyRoundTrip(point); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestSelfTest runs the -selftest checks.
+func TestSelfTest(t *testing.T) {
+	if failures := selfTest(context.Background(), 200, 1); failures > 0 {
+		t.Fatalf("%d failures", failures)
+	}
+}
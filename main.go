@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image/color"
+	"io"
 	"log"
+	"math"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +26,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 const (
@@ -35,94 +44,164 @@ type GeoPoint struct {
 	Coordinates []float64 `bson:"coordinates" json:"coordinates"`
 }
 
+type GeoPolygon struct {
+	Type        string        `bson:"type" json:"type"`
+	Coordinates [][][]float64 `bson:"coordinates" json:"coordinates"`
+}
+
 type Tile struct {
 	X, Y, Z    uint32
 	Key        string
+	Geometry   *GeoPolygon `bson:"geometry,omitempty"` // Tile footprint, for $geoIntersects
 	orbmaptile *maptile.Tile
 }
 
-func (t *Tile) Center() [2]float64 {
+func (t *Tile) orbTile() *maptile.Tile {
 	if t.orbmaptile == nil {
 		_tmp := maptile.New(t.X, t.Y, maptile.Zoom(t.Z))
 		t.orbmaptile = &_tmp
 	}
-	return t.orbmaptile.Center()
+	return t.orbmaptile
+}
+
+func (t *Tile) Center() [2]float64 {
+	return projection.Center(*t.orbTile())
+}
+
+// Polygon is the tile footprint, counter-clockwise from the south-west corner.
+func (t *Tile) Polygon() GeoPolygon {
+	return toGeoPolygon(projection.Bound(*t.orbTile()).ToPolygon())
 }
 
 type Record struct {
-	ID       primitive.ObjectID `bson:"_id"`                      // ObjectID
-	Location GeoPoint           `bson:"location" json:"location"` // Raw point
-	Levels   []Tile             `bson:"levels" json:"-"`          // Not export to outside in JSON
+	ID         primitive.ObjectID     `bson:"_id"`                                              // ObjectID
+	Location   GeoPoint               `bson:"location" json:"location"`                         // Raw point
+	Levels     []Tile                 `bson:"levels" json:"-"`                                  // Not export to outside in JSON
+	Properties map[string]interface{} `bson:"properties,omitempty" json:"properties,omitempty"` // Arbitrary source properties
+	SourceKey  string                 `bson:"sourceKey,omitempty" json:"-"`                     // Natural key of the source row, for -dedup-key
+	Timestamp  *time.Time             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`   // Event time, for time bucketed frames
+	Count      *int                   `bson:"count,omitempty" json:"count,omitempty"`           // Pre-aggregated count, nil counts as 1
+	Grid       *GridCell              `bson:"grid,omitempty" json:"-"`                          // Metric grid cell, for -grid-size
+	Shape      string                 `bson:"shape,omitempty" json:"-"`                         // WKT of a line or polygon source, Levels cover it
+	ShardKey   *int64                 `bson:"shardKey,omitempty" json:"-"`                      // Hashed shard key, for -shard-key-field
+	Row        int                    `bson:"-" json:"-"`                                       // Source line, or GeoJSON feature index, for -checkpoint
 }
 
 func (r *Record) SetLevels() {
-	r.Levels = make([]Tile, 0)
-	for z := minZoom; z <= maxZoom; z++ {
-		orbmaptile := maptile.At(orb.Point{r.Location.Coordinates[0], r.Location.Coordinates[1]}, maptile.Zoom(z))
-		x := orbmaptile.X
-		y := orbmaptile.Y
-		r.Levels = append(r.Levels, Tile{
-			X:          x,
-			Y:          y,
-			Z:          uint32(z),
-			Key:        fmt.Sprintf("%v-%v-%v", x, y, z),
-			orbmaptile: &orbmaptile,
-		})
+	keys := indexer.Index(orb.Point{r.Location.Coordinates[0], r.Location.Coordinates[1]})
+	r.Levels = make([]Tile, 0, len(keys))
+	for i, key := range keys {
+		tile := Tile{Z: uint32(minZoom + i), Key: key}
+		// X and Y are only meaningful for map tile keys.
+		if orbmaptile, err := ParseTileKey(key); err == nil {
+			tile.X, tile.Y, tile.orbmaptile = orbmaptile.X, orbmaptile.Y, &orbmaptile
+		}
+		r.Levels = append(r.Levels, tile)
 	}
 }
 
-// https://data.cityofnewyork.us/Social-Services/311-Service-Requests-from-2010-to-Present/7ahn-ypff
-//
-// https://gist.githubusercontent.com/kashuk/670a350ea1f9fc543c3f6916ab392f62/raw/4c5ced45cc94d5b00e3699dd211ad7125ee6c4d3/NYC311_noise.csv
-//
-//go:embed NYC311_noise.csv
-var exampleGeosCSV []byte
+// minGeometryZoom is the first level SetLevelGeometries stores, coarser
+// tiles span 180° or more of longitude which 2dsphere can't index.
+const minGeometryZoom = 2
 
-func SetupDemoData() []Record {
-	lines := strings.Split(string(exampleGeosCSV), "\n")
-	ret := make([]Record, 0)
-	for index, line := range lines {
-		if index == 0 {
+// SetLevelGeometries stores each level's tile polygon, enabling
+// $geoIntersects against `levels.geometry` with its 2dsphere index. It adds
+// about 150 bytes of BSON per level, nearly 2KB per record. 2dsphere treats
+// edges as great circles, so the north and south edges bow slightly compared
+// to the tile's parallels.
+func (r *Record) SetLevelGeometries() {
+	for i := range r.Levels {
+		tile := &r.Levels[i]
+		if tile.Z < minGeometryZoom {
 			continue
 		}
-		rawparts := strings.Split(line, ",")
-		if len(rawparts) != 2 {
+		_, geometry := indexer.Decode(tile.Key)
+		polygon, ok := geometry.(orb.Polygon)
+		if !ok {
 			continue
 		}
-		lat_str := rawparts[0]
-		long_str := rawparts[1]
+		geoPolygon := toGeoPolygon(polygon)
+		tile.Geometry = &geoPolygon
+	}
+}
 
-		lat_float, err := strconv.ParseFloat(lat_str, 64)
-		if err != nil {
-			panic(err)
-		}
-		long_float, err := strconv.ParseFloat(long_str, 64)
-		if err != nil {
-			panic(err)
-		}
-		record := Record{
-			ID:       primitive.NewObjectID(),
-			Location: GeoPoint{Type: "Point", Coordinates: []float64{long_float, lat_float}},
+// toGeoPolygon converts an orb polygon to its GeoJSON form.
+func toGeoPolygon(polygon orb.Polygon) GeoPolygon {
+	rings := make([][][]float64, 0, len(polygon))
+	for _, orbRing := range polygon {
+		ring := make([][]float64, 0, len(orbRing))
+		for _, point := range orbRing {
+			ring = append(ring, []float64{point.Lon(), point.Lat()})
 		}
-		record.SetLevels()
-		ret = append(ret, record)
+		rings = append(rings, ring)
 	}
-	return ret
+	return GeoPolygon{Type: "Polygon", Coordinates: rings}
+}
+
+// https://data.cityofnewyork.us/Social-Services/311-Service-Requests-from-2010-to-Present/7ahn-ypff
+//
+// https://gist.githubusercontent.com/kashuk/670a350ea1f9fc543c3f6916ab392f62/raw/4c5ced45cc94d5b00e3699dd211ad7125ee6c4d3/NYC311_noise.csv
+//
+//go:embed NYC311_noise.csv
+var exampleGeosCSV []byte
+
+// RowKey hashes a source row with its position, identical rows at different
+// positions are distinct records.
+func RowKey(index int, line string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d:%s", index, line)))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetupDemoData parses the embedded CSV, or the -demo-csv override, rows whose coordinates still fail
+// to parse after cleanup are skipped and counted.
+func SetupDemoData(opts ParseOptions) (records []Record, failed int, err error) {
+	return ParseCSV(bytes.NewReader(exampleGeosCSV), opts)
 }
 
 type RawStats struct {
-	ID    string `bson:"_id"`
-	Count int    `bson:"count"`
+	ID    string   `bson:"_id"`
+	Count int      `bson:"count"`
+	Lng   *float64 `bson:"lng,omitempty"` // Centroid of the raw points, for -geometry centroid
+	Lat   *float64 `bson:"lat,omitempty"`
+	// DeviceCount is how many distinct Options.DistinctField values the
+	// tile's records have, for -distinct.
+	DeviceCount *int `bson:"deviceCount,omitempty"`
+	// Points are the tile's distinct raw coordinates, for -geometry hull.
+	Points [][]float64 `bson:"points,omitempty"`
+	// Kernel is the count spread from this and neighboring tiles, for
+	// -kernel.
+	Kernel *float64 `bson:"-"`
+}
+
+// TileKey formats the `x-y-z` key stored in Record.Levels with the default
+// -key-format.
+func TileKey(tile maptile.Tile) string {
+	return fmt.Sprintf("%v-%v-%v", tile.X, tile.Y, tile.Z)
+}
+
+// ParseTileKey parses a `x-y-z` key as built by SetLevels, or its
+// CompactTileKey form.
+func ParseTileKey(key string) (maptile.Tile, error) {
+	if !strings.Contains(key, "-") {
+		return ParseCompactTileKey(key)
+	}
+	parts := strings.Split(key, "-")
+	if len(parts) != 3 {
+		return maptile.Tile{}, fmt.Errorf("invalid tile key %q", key)
+	}
+	var xyz [3]uint32
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return maptile.Tile{}, fmt.Errorf("invalid tile key %q: %w", key, err)
+		}
+		xyz[i] = uint32(v)
+	}
+	return maptile.New(xyz[0], xyz[1], maptile.Zoom(xyz[2])), nil
 }
 
 func FromRawStatsToGeoJSONFeatureItem(raw RawStats) GeoJSONFeatureItem {
-	parts := strings.Split(raw.ID, "-")
-	xStr, yStr, zStr := parts[0], parts[1], parts[2]
-	x, _ := strconv.ParseInt(xStr, 10, 64)
-	y, _ := strconv.ParseInt(yStr, 10, 64)
-	z, _ := strconv.ParseInt(zStr, 10, 64)
-	obrMapTile := maptile.New(uint32(x), uint32(y), maptile.Zoom(z))
-	center := obrMapTile.Center()
+	center, _ := indexer.Decode(raw.ID)
 	centerLng := center[0]
 	centerLat := center[1]
 	return GeoJSONFeatureItem{
@@ -135,86 +214,1160 @@ func FromRawStatsToGeoJSONFeatureItem(raw RawStats) GeoJSONFeatureItem {
 	}
 }
 
+// clampCount caps count at opts.ClampCount for display, unchanged without
+// -clamp-count.
+func clampCount(count int, opts Options) int {
+	if opts.ClampCount > 0 && count > opts.ClampCount {
+		return opts.ClampCount
+	}
+	return count
+}
+
+// normalizations are the valid -normalize values, adding a `normalized`
+// property.
+var normalizations = map[string]bool{
+	"":    true, // Disabled
+	"max": true, // count divided by the largest count in the result
+}
+
+// normalize sets `normalized` to count/max of rawRes, features are in
+// rawRes order.
+func normalize(features []GeoJSONFeatureItem, rawRes []RawStats) {
+	max := 0
+	for _, item := range rawRes {
+		if item.Count > max {
+			max = item.Count
+		}
+	}
+	for i, item := range rawRes {
+		normalized := 0.0
+		if max > 0 {
+			normalized = float64(item.Count) / float64(max)
+		}
+		features[i].Properties["normalized"] = normalized
+	}
+}
+
+// outputProperties are the valid -output-properties names.
+var outputProperties = map[string]bool{
+	"count":       true,
+	"tileKey":     true,
+	"logCount":    true, // -log-scale
+	"kernel":      true, // -kernel
+	"rawCount":    true, // -clamp-count
+	"deviceCount": true, // -distinct
+	"baseline":    true, // -baseline
+	"ratio":       true, // -baseline-metric ratio
+	"zScore":      true, // -baseline-metric zscore
+	"noBaseline":  true, // -baseline
+	"bucket":      true, // -buckets
+	"normalized":  true, // -normalize
+	"density":     true, // -blend-level
+	"distance":    true, // -nearest
+	"gridKey":     true, // -grid-size
+	"cellSize":    true,
+	"cellBbox":    true,
+}
+
+// parseOutputProperties parses comma separated outputProperties names.
+func parseOutputProperties(raw string) (map[string]bool, error) {
+	keep := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if !outputProperties[name] {
+			return nil, fmt.Errorf("unknown property %q", name)
+		}
+		keep[name] = true
+	}
+	return keep, nil
+}
+
+// selectProperties drops the properties not in keep, nil keeps all.
+func selectProperties(features []GeoJSONFeatureItem, keep map[string]bool) {
+	if keep == nil {
+		return
+	}
+	for _, feature := range features {
+		for name := range feature.Properties {
+			if !keep[name] {
+				delete(feature.Properties, name)
+			}
+		}
+	}
+}
+
 type GeoJSONFeatureItem struct {
+	ID         string                 `json:"id,omitempty"` // Tile key, set with -feature-id
 	Type       string                 `json:"type"`
 	Properties map[string]interface{} `json:"properties"`
 	Geometry   GeoPoint               `json:"geometry"`
+	// Polygon is the tile footprint with -geometry both, written together
+	// with Geometry as a GeometryCollection.
+	Polygon *GeoPolygon `json:"-"`
+	// Hull replaces Geometry with -geometry hull.
+	Hull *GeoPolygon `json:"-"`
+}
+
+type GeoGeometryCollection struct {
+	Type       string        `json:"type"`
+	Geometries []interface{} `json:"geometries"`
+}
+
+func (f GeoJSONFeatureItem) MarshalJSON() ([]byte, error) {
+	type plain GeoJSONFeatureItem
+	if f.Hull != nil {
+		return json.Marshal(struct {
+			plain
+			Geometry GeoPolygon `json:"geometry"`
+		}{plain: plain(f), Geometry: *f.Hull})
+	}
+	if f.Polygon == nil {
+		return json.Marshal(plain(f))
+	}
+	return json.Marshal(struct {
+		plain
+		Geometry GeoGeometryCollection `json:"geometry"`
+	}{
+		plain:    plain(f),
+		Geometry: GeoGeometryCollection{Type: "GeometryCollection", Geometries: []interface{}{f.Geometry, *f.Polygon}},
+	})
 }
 
 type GeoJSONFeatures struct {
 	Type     string               `json:"type"`
 	Features []GeoJSONFeatureItem `json:"features"`
+	Breaks   []float64            `json:"breaks,omitempty"` // Foreign member, set with -buckets
+	// Foreign members documenting CLI exports, see setMetadata.
+	GeneratedAt string `json:"generatedAt,omitempty"` // RFC 3339, UTC
+	Zoom        *int   `json:"zoom,omitempty"`        // Zoom of the tile keys, unset for grid cells
+	Source      string `json:"source,omitempty"`      // Aggregated database and collections
+	MinCount    int    `json:"minCount,omitempty"`    // -min-count floor applied, 0 or 1 for none
+	ClampCount  int    `json:"clampCount,omitempty"`  // -clamp-count cap of the count property
+}
+
+// setMetadata sets the foreign members of an export at zoom. The server
+// leaves them out since generatedAt would change every ETag.
+func (fc *GeoJSONFeatures) setMetadata(zoom int, opts Options) {
+	fc.GeneratedAt = time.Now().UTC().Format(time.RFC3339)
+	fc.Source = opts.Source
+	fc.MinCount = opts.MinCount.Default
+	if opts.GridSize == 0 {
+		fc.Zoom = &zoom
+		fc.MinCount = opts.MinCount.At(zoom)
+	}
+	fc.ClampCount = opts.ClampCount
+}
+
+// parseBound parses `minLng,minLat,maxLng,maxLat`.
+func parseBound(raw string) (orb.Bound, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return orb.Bound{}, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat, got %q", raw)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("invalid bbox %q: %w", raw, err)
+		}
+		v[i] = f
+	}
+	if v[0] > v[2] || v[1] > v[3] {
+		return orb.Bound{}, fmt.Errorf("invalid bbox %q: min greater than max", raw)
+	}
+	return orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}, nil
+}
+
+// sortOrders maps the -sort flag values to a final `$sort`, ties are broken
+// by key so the output order is always deterministic.
+var sortOrders = map[string]bson.D{
+	"key":   {{Key: "_id", Value: 1}},
+	"count": {{Key: "count", Value: -1}, {Key: "_id", Value: 1}},
+}
+
+// PropertyFilter is an equality condition on `properties.<Field>`.
+type PropertyFilter struct {
+	Field string
+	Value interface{}
+}
+
+// PropertyFilters implements flag.Value for repeatable `-filter field=value`.
+type PropertyFilters []PropertyFilter
+
+func (f *PropertyFilters) String() string {
+	parts := make([]string, len(*f))
+	for i, filter := range *f {
+		parts[i] = fmt.Sprintf("%s=%v", filter.Field, filter.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *PropertyFilters) Set(raw string) error {
+	field, value, ok := strings.Cut(raw, "=")
+	if !ok || field == "" {
+		return fmt.Errorf("filter must be field=value, got %q", raw)
+	}
+	*f = append(*f, PropertyFilter{Field: field, Value: parseFilterValue(value)})
+	return nil
+}
+
+// parseFilterValue guesses bool, number or string. Quote a value to force
+// it to be a string, e.g. `zip="10001"`.
+func parseFilterValue(raw string) interface{} {
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		return unquoted
+	}
+	if raw == "true" || raw == "false" {
+		return raw == "true"
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f
+	}
+	return raw
+}
+
+// Options controls the aggregation and how its results are rendered.
+type Options struct {
+	Filters     PropertyFilters // Equality matches on record properties
+	Search      string          // Atlas Search text query, empty to disable
+	SearchIndex string          // Atlas Search index name
+	// BBox keeps raw points inside it before grouping, tiles crossing its
+	// edge are partially counted and their centers may lie outside.
+	BBox *orb.Bound
+	// SnapBBox grows BBox to full tile boundaries at the stored level, with
+	// -zoom-offset applied.
+	SnapBBox bool
+	// ROI drops grouped tiles whose center lies outside it, the counts of
+	// kept tiles are complete.
+	ROI *orb.Bound
+	// Boundary drops grouped tiles whose center lies outside it, like ROI
+	// with a country's polygons.
+	Boundary orb.MultiPolygon
+	// Within only counts records inside this tile key, e.g. a requested MVT.
+	Within string
+	// Band only counts tiles whose key matches it, see TilesInRow and
+	// TilesInColumn, nil to disable.
+	Band *primitive.Regex
+	// Ring only counts tiles within Ring.K tiles of its center, nil to
+	// disable.
+	Ring *TileRing
+	// DistinctField also counts distinct properties.<DistinctField> values
+	// per tile into RawStats.DeviceCount, empty to disable.
+	DistinctField string
+	// DistinctMemoryMB refuses DistinctField when the sets would likely
+	// need more, or with DistinctApprox counts them in Go with a
+	// HyperLogLog instead. 0 to disable.
+	DistinctMemoryMB int
+	DistinctApprox   bool
+	// UnionWith adds these collections with $unionWith before grouping,
+	// needs MongoDB 4.4.
+	UnionWith []string
+	// Baseline adds a comparison of each count with the expected one,
+	// BaselineMetric picks the key of baselineMetrics. Nil to disable.
+	Baseline       Baseline
+	BaselineMetric string
+	// Mask only counts records inside this Polygon or MultiPolygon, before
+	// grouping.
+	Mask orb.Geometry
+	// Circle only counts records within its radius, before grouping, nil to
+	// disable. Exclusive with Mask.
+	Circle           *Circle
+	IncludeEmpty     bool            // Emit zero counts for tiles covering BBox without data
+	Window           time.Duration   // Only count records newer than now minus Window
+	Sort             string          // Key of sortOrders
+	Buckets          int             // Number of count classes, 0 to disable
+	Classify         string          // Key of classifiers
+	Format           string          // Key of formats
+	TilePolygons     bool            // GeoParquet tile polygons instead of points
+	PostgresDSN      string          // Also upsert results into Postgres, empty to disable
+	PostgresTable    string          // Table for PostgresDSN
+	Indent           string          // JSON output indentation, empty for compact
+	OutDir           string          // Write multi-level output as `{z}.geojson` files here
+	Geometry         string          // Key of geometries
+	LogScale         bool            // Add `logCount` (log1p of count) to properties
+	ClampCount       int             // Cap the count property, keeping `rawCount`, 0 to disable
+	Kernel           float64         // Gaussian bandwidth in tile widths for the `kernel` property, 0 to disable
+	FeatureID        bool            // Set the top-level feature id to the key
+	Normalize        string          // Key of normalizations, empty to disable
+	OutputProperties map[string]bool // Feature properties to keep, nil keeps all
+	Ramp             []color.RGBA    // Color ramp for PNG heatmaps, low to high
+	GridSize         float64         // Aggregate by GridCell of this size in meters instead of tiles
+	MinCount         MinCounts       // Drop tiles below these counts after grouping
+	Source           string          // `database.collection` recorded in exports, see setMetadata
+	Datasets         []string        // Only count level keys of these -dataset namespaces, nil for unprefixed keys
+	MaxFeatures      int             // Refuse aggregations returning more features, 0 for no limit
+	AllowDiskUse     bool            // Let large $group stages spill to disk
+	CursorBatchSize  int32           // Documents per aggregation cursor batch
+	PlaybackSpeed    float64         // Frames per second of /stream replays
+	CacheMaxAge      time.Duration   // Cache-Control max-age of /tiles responses
+	Overzoom         int             // Levels beyond maxZoom served from maxZoom ancestors
+	// ZoomOffset is added to every requested level before matching stored
+	// levels. Tiles of 512px show a level's area at twice the size, an
+	// offset of 1 keeps the feature density of 256px tiles.
+	ZoomOffset int
+}
+
+// geometries are the valid -geometry values.
+var geometries = map[string]bool{
+	"center":   true, // Tile center
+	"centroid": true, // Average of the raw points in the tile
+	// Tile center at -level, with -pyramid coarser tiles use the
+	// count-weighted average of their children's positions.
+	"weighted": true,
+	// Tile center and polygon in a GeometryCollection, to label at the center
+	// and shade the tile. Features are about 3 times the size of center ones.
+	"both": true,
+	// Convex hull of the raw points in the tile, the center with fewer than
+	// 3 distinct points. Every point is sent to the client to compute it.
+	"hull": true,
+}
+
+// countSum adds up Record.Count, records without one count once.
+var countSum = bson.M{"$sum": bson.M{"$ifNull": bson.A{"$count", 1}}}
+
+// TilesInRow matches the keys of every tile in row y at zoom z, a
+// latitude band.
+func TilesInRow(z maptile.Zoom, y uint32) primitive.Regex {
+	return primitive.Regex{Pattern: fmt.Sprintf(`^\d+-%d-%d$`, y, z)}
+}
+
+// TilesInColumn matches the keys of every tile in column x at zoom z, a
+// longitude band.
+func TilesInColumn(z maptile.Zoom, x uint32) primitive.Regex {
+	return primitive.Regex{Pattern: fmt.Sprintf(`^%d-\d+-%d$`, x, z)}
+}
+
+// storedZoom maps a requested zoom to the stored one, shifted by
+// ZoomOffset and clamped to the indexed range.
+func storedZoom(level int, opts Options) int {
+	z := level + opts.ZoomOffset
+	if z < minZoom {
+		return minZoom
+	}
+	if z > maxZoom {
+		return maxZoom
+	}
+	return z
+}
+
+// buildMatch is the first $match of the aggregation, selecting records that
+// have the level and pass the configured filters.
+func buildMatch(level int, opts Options) bson.M {
+	match := bson.M{"levels.z": storedZoom(level, opts)}
+	if opts.Within != "" {
+		match["levels.key"] = storedKey(opts.Within)
+	}
+	if opts.Band != nil {
+		match["levels.key"] = *opts.Band
+	}
+	if opts.Ring != nil {
+		match["levels.key"] = bson.M{"$in": storedKeys(RingKeys(*opts.Ring, maptile.Zoom(storedZoom(level, opts))))}
+	}
+	for _, filter := range opts.Filters {
+		match["properties."+filter.Field] = filter.Value
+	}
+	if opts.BBox != nil {
+		bound := *opts.BBox
+		if opts.SnapBBox && opts.GridSize == 0 {
+			bound = SnapBoundToTiles(bound, storedZoom(level, opts))
+		}
+		match["location.coordinates.0"] = bson.M{"$gte": bound.Min.Lon(), "$lte": bound.Max.Lon()}
+		match["location.coordinates.1"] = bson.M{"$gte": bound.Min.Lat(), "$lte": bound.Max.Lat()}
+	}
+	if opts.Mask != nil {
+		match["location"] = maskMatch(opts.Mask)
+	}
+	if opts.Circle != nil {
+		match["location"] = circleMatch(*opts.Circle)
+	}
+	if opts.Window > 0 {
+		// Computed on every call so the window slides with each request.
+		match["timestamp"] = bson.M{"$gte": time.Now().Add(-opts.Window)}
+	}
+	setDatasetMatch(match, opts)
+	return match
+}
+
+// buildLevelMatch keeps the unwound levels of the stored zoom, and of
+// -row/-column or -ring keys.
+func buildLevelMatch(level int, opts Options) bson.M {
+	levelMatch := bson.M{"levels.z": storedZoom(level, opts)}
+	if opts.Band != nil {
+		levelMatch["levels.key"] = *opts.Band
+	}
+	if opts.Ring != nil {
+		levelMatch["levels.key"] = bson.M{"$in": storedKeys(RingKeys(*opts.Ring, maptile.Zoom(storedZoom(level, opts))))}
+	}
+	if _, ok := levelMatch["levels.key"]; ok {
+		setDatasetMatch(levelMatch, opts)
+	}
+	return levelMatch
 }
 
-func demo(ctx context.Context, repo *xmongo.Repo[Record], level int) {
+func buildPipeline(level int, opts Options) bson.A {
+	match := buildMatch(level, opts)
+	group := bson.M{
+		"_id":   levelKey(opts),
+		"count": countSum,
+	}
+	if opts.DistinctField != "" {
+		group["devices"] = bson.M{"$addToSet": "$properties." + opts.DistinctField}
+	}
+	if opts.Geometry == "hull" {
+		group["points"] = bson.M{"$addToSet": "$location.coordinates"}
+	}
+	if opts.Geometry == "centroid" || opts.Kernel > 0 {
+		group["lng"] = bson.M{"$avg": bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 0}}}
+		group["lat"] = bson.M{"$avg": bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 1}}}
+	}
 	pipes := bson.A{
 		bson.M{
-			"$match": bson.M{"levels.z": level},
+			"$match": match,
 		},
 		bson.M{
 			"$unwind": "$levels",
 		},
 		bson.M{
-			"$match": bson.M{"levels.z": level},
+			"$match": buildLevelMatch(level, opts),
 		},
 		bson.M{
-			"$group": bson.M{
-				"_id":   "$levels.key",
-				"count": bson.M{"$sum": 1},
-			},
+			"$group": group,
 		},
 	}
-	cursor, err := repo.Aggregate(ctx, pipes)
+	if opts.GridSize > 0 {
+		delete(match, "levels.z")
+		match["grid.size"] = opts.GridSize
+		group["_id"] = "$grid.key"
+		pipes = bson.A{
+			bson.M{
+				"$match": match,
+			},
+			bson.M{
+				"$group": group,
+			},
+		}
+	}
+	if len(opts.UnionWith) > 0 {
+		// Each collection filters and unwinds on its own, then all are
+		// grouped together.
+		last := len(pipes) - 1
+		prefix := pipes[:last]
+		grouped := append(bson.A{}, prefix...)
+		for _, name := range opts.UnionWith {
+			grouped = append(grouped, bson.M{"$unionWith": bson.M{"coll": name, "pipeline": prefix}})
+		}
+		pipes = append(grouped, pipes[last])
+	}
+	if floor := minCountFloor(level, opts); floor > 1 {
+		pipes = append(pipes, bson.M{"$match": bson.M{"count": bson.M{"$gte": floor}}})
+	}
+	if opts.DistinctField != "" {
+		// Only the set size leaves the server.
+		pipes = append(pipes,
+			bson.M{"$addFields": bson.M{"deviceCount": bson.M{"$size": "$devices"}}},
+			bson.M{"$project": bson.M{"devices": 0}},
+		)
+	}
+	if opts.Search != "" {
+		// $search must be the first stage of a pipeline.
+		search := bson.M{
+			"$search": bson.M{
+				"index": opts.SearchIndex,
+				"text": bson.M{
+					"query": opts.Search,
+					"path":  bson.M{"wildcard": "*"},
+				},
+			},
+		}
+		pipes = append(bson.A{search}, pipes...)
+	}
+	if order, ok := sortOrders[opts.Sort]; ok {
+		pipes = append(pipes, bson.M{"$sort": order})
+	}
+	return pipes
+}
+
+// dumpPipeline writes the pipeline for level as relaxed extended JSON, one
+// stage per element, indented by indent. MarshalExtJSON only takes
+// documents, so stages are marshaled one by one.
+func dumpPipeline(w io.Writer, level int, opts Options, indent string) error {
+	stages := make([]json.RawMessage, 0)
+	for _, stage := range buildPipeline(level, opts) {
+		content, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			return err
+		}
+		stages = append(stages, content)
+	}
+	content, err := marshalJSON(stages, indent)
 	if err != nil {
-		log.Panicln("Aggregate err", err.Error())
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(content))
+	return err
+}
+
+// checkSearchIndex errors if the Atlas Search index doesn't exist, since
+// $search silently returns nothing in that case.
+func checkSearchIndex(ctx context.Context, repo RecordRepo, name string) error {
+	cursor, err := repo.Aggregate(ctx, bson.A{bson.M{"$listSearchIndexes": bson.M{"name": name}}})
+	if err != nil {
+		return fmt.Errorf("-search needs an Atlas Search index, list search indexes: %w", err)
 	}
-	rawRes, err := xmongo.Decode[RawStats](ctx, cursor)
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		return fmt.Errorf("-search needs an Atlas Search index, index %q not found", name)
+	}
+	return nil
+}
+
+func aggregateOptions(opts Options) *options.AggregateOptions {
+	return options.Aggregate().
+		SetAllowDiskUse(opts.AllowDiskUse).
+		SetBatchSize(opts.CursorBatchSize)
+}
+
+// TooManyFeaturesError is returned when an aggregation would produce more
+// features than Options.MaxFeatures.
+type TooManyFeaturesError struct {
+	Count, Limit int
+}
+
+func (e *TooManyFeaturesError) Error() string {
+	return fmt.Sprintf("aggregation would return %d features, over the limit of %d, use a coarser level or a bbox", e.Count, e.Limit)
+}
+
+// countFeatures counts the groups an aggregation would return, without
+// building them.
+func countFeatures(ctx context.Context, repo RecordRepo, level int, opts Options) (int, error) {
+	opts.Sort, opts.Geometry = "", ""
+	pipes := append(buildPipeline(level, opts), bson.M{"$count": "count"})
+	cursor, err := repo.Aggregate(ctx, pipes, aggregateOptions(opts))
 	if err != nil {
-		log.Panicln("Decode err", err.Error())
+		return 0, fmt.Errorf("count: %w", err)
 	}
+	res, err := xmongo.Decode[RawStats](ctx, cursor)
+	if err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0].Count, nil
+}
 
+func aggregate(ctx context.Context, repo RecordRepo, level int, opts Options) ([]RawStats, error) {
+	if opts.MaxFeatures > 0 {
+		count, err := countFeatures(ctx, repo, level, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.IncludeEmpty && opts.BBox != nil && opts.ROI == nil && opts.Boundary == nil {
+			// The dense grid is known before aggregating, refuse it early,
+			// unless clipping may shrink it.
+			topLeft, bottomRight := tileRange(*opts.BBox, storedZoom(level, opts))
+			if grid := int(bottomRight.X-topLeft.X+1) * int(bottomRight.Y-topLeft.Y+1); grid > count {
+				count = grid
+			}
+		}
+		if count > opts.MaxFeatures {
+			return nil, &TooManyFeaturesError{Count: count, Limit: opts.MaxFeatures}
+		}
+	}
+	if opts.Search != "" {
+		if err := checkSearchIndex(ctx, repo, opts.SearchIndex); err != nil {
+			return nil, err
+		}
+	}
+	approx, err := checkDistinctMemory(ctx, repo, level, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rawRes []RawStats
+	if approx {
+		rawRes, err = aggregateApproxDistinct(ctx, repo, level, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cursor, err := repo.Aggregate(ctx, buildPipeline(level, opts), aggregateOptions(opts))
+		if err != nil {
+			return nil, fmt.Errorf("aggregate: %w", err)
+		}
+		rawRes, err = xmongo.Decode[RawStats](ctx, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+	expandKeys(rawRes)
+	if opts.Kernel > 0 {
+		rawRes, err = spreadKernel(rawRes, storedZoom(level, opts), opts.Kernel, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.IncludeEmpty && opts.BBox != nil {
+		rawRes, err = fillEmptyTiles(rawRes, *opts.BBox, storedZoom(level, opts), opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ROI != nil {
+		rawRes = clipToBound(rawRes, *opts.ROI, opts)
+	}
+	if opts.Boundary != nil {
+		rawRes = clipToPolygon(rawRes, opts.Boundary, opts)
+	}
+	// countFeatures only sees grouped tiles, not -kernel neighbors or
+	// -include-empty ones.
+	if opts.MaxFeatures > 0 && len(rawRes) > opts.MaxFeatures {
+		return nil, &TooManyFeaturesError{Count: len(rawRes), Limit: opts.MaxFeatures}
+	}
+	return rawRes, nil
+}
+
+// maxEmptyTiles bounds how many tiles -include-empty may enumerate.
+const maxEmptyTiles = 1 << 20
+
+// fillEmptyTiles adds a zero count for every tile covering bound without
+// one, so the result is a dense grid.
+func fillEmptyTiles(rawRes []RawStats, bound orb.Bound, level int, order string) ([]RawStats, error) {
+	topLeft, bottomRight := tileRange(bound, level)
+	total := int(bottomRight.X-topLeft.X+1) * int(bottomRight.Y-topLeft.Y+1)
+	if total > maxEmptyTiles {
+		return nil, fmt.Errorf("bbox covers %d tiles at level %d, over the -include-empty limit of %d", total, level, maxEmptyTiles)
+	}
+	seen := make(map[string]bool, len(rawRes))
+	for _, item := range rawRes {
+		seen[item.ID] = true
+	}
+	for x := topLeft.X; x <= bottomRight.X; x++ {
+		for y := topLeft.Y; y <= bottomRight.Y; y++ {
+			key := TileKey(maptile.New(x, y, maptile.Zoom(level)))
+			if !seen[key] {
+				rawRes = append(rawRes, RawStats{ID: key})
+			}
+		}
+	}
+	sortStats(rawRes, order)
+	return rawRes, nil
+}
+
+// cellCenter returns the center of a tile, or grid cell with -grid-size.
+func cellCenter(key string, opts Options) (orb.Point, error) {
+	if opts.GridSize > 0 {
+		_, bound, err := ParseGridKey(key)
+		return bound.Center(), err
+	}
+	tile, err := ParseTileKey(key)
+	return projection.Center(tile), err
+}
+
+// clipToBound keeps tiles whose center lies inside bound.
+func clipToBound(rawRes []RawStats, bound orb.Bound, opts Options) []RawStats {
+	res := make([]RawStats, 0, len(rawRes))
+	for _, item := range rawRes {
+		center, err := cellCenter(item.ID, opts)
+		if err != nil || !bound.Contains(center) {
+			continue
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+func toFeatureCollection(rawRes []RawStats, opts Options) GeoJSONFeatures {
 	res := make([]GeoJSONFeatureItem, len(rawRes))
 	for index, item := range rawRes {
-		res[index] = FromRawStatsToGeoJSONFeatureItem(item)
+		feature := FromRawStatsToGeoJSONFeatureItem(item)
+		if opts.GridSize > 0 {
+			feature = FromGridStatsToGeoJSONFeatureItem(item)
+		}
+		if item.Lng != nil && item.Lat != nil {
+			feature.Geometry.Coordinates = []float64{*item.Lng, *item.Lat}
+		}
+		if opts.FeatureID {
+			feature.ID = item.ID
+		}
+		if opts.Geometry == "both" {
+			polygon := toGeoPolygon(statsGeometry(item, feature, opts, true).(orb.Polygon))
+			feature.Polygon = &polygon
+		}
+		if opts.Geometry == "hull" {
+			if hull, ok := convexHull(item.Points); ok {
+				polygon := toGeoPolygon(hull)
+				feature.Hull = &polygon
+			}
+		}
+		if item.DeviceCount != nil {
+			feature.Properties["deviceCount"] = *item.DeviceCount
+		}
+		if opts.ClampCount > 0 {
+			feature.Properties["count"] = clampCount(item.Count, opts)
+			feature.Properties["rawCount"] = item.Count
+		}
+		if item.Kernel != nil {
+			feature.Properties["kernel"] = *item.Kernel
+		}
+		if opts.LogScale {
+			feature.Properties["logCount"] = math.Log1p(float64(item.Count))
+		}
+		res[index] = feature
+	}
+	if opts.Normalize == "max" {
+		normalize(res, rawRes)
+	}
+	if opts.Baseline != nil {
+		compareBaseline(res, rawRes, opts.Baseline, opts.BaselineMetric)
 	}
-	finalRes := GeoJSONFeatures{
+	breaks := classify(res, rawRes, opts)
+	selectProperties(res, opts.OutputProperties)
+	return GeoJSONFeatures{
 		Type:     "FeatureCollection",
 		Features: res,
+		Breaks:   breaks,
+	}
+}
+
+// marshalJSON indents v by indent, compact if indent is empty.
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+	if indent == "" {
+		return json.Marshal(v)
 	}
+	return json.MarshalIndent(v, "", indent)
+}
 
-	content, _ := json.MarshalIndent(finalRes, "", "  ")
+func printJSON(v interface{}, indent string) {
+	content, _ := marshalJSON(v, indent)
 	fmt.Println(string(content))
 }
 
+func demo(ctx context.Context, repo RecordRepo, level int, opts Options) {
+	rawRes, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		log.Panicln("Aggregate err", err.Error())
+	}
+	if err := writeOutput(os.Stdout, rawRes, storedZoom(level, opts), opts); err != nil {
+		log.Panicln("Output err", err.Error())
+	}
+	if opts.PostgresDSN != "" {
+		if err := writePostgres(ctx, opts.PostgresDSN, opts.PostgresTable, level, rawRes, opts); err != nil {
+			log.Panicln("Postgres err", err.Error())
+		}
+	}
+}
+
+// writeOutput writes rawRes, tiles at zoom, to w in opts.Format.
+func writeOutput(w io.Writer, rawRes []RawStats, zoom int, opts Options) error {
+	switch opts.Format {
+	case "geoparquet":
+		return writeGeoParquet(w, rawRes, opts, opts.TilePolygons)
+	case "fgb":
+		return writeFlatGeobuf(w, rawRes, opts, opts.TilePolygons)
+	case "ndjson":
+		return writeNDJSON(w, toFeatureCollection(rawRes, opts))
+	case "mbtiles":
+		return errors.New("mbtiles is a SQLite file written with -out, not a stream")
+	}
+	fc := toFeatureCollection(rawRes, opts)
+	fc.setMetadata(zoom, opts)
+	content, err := marshalJSON(fc, opts.Indent)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(content))
+	return err
+}
+
+// writeConcerns maps the -write-concern flag values, empty means server default.
+var writeConcerns = map[string]*writeconcern.WriteConcern{
+	"":         nil,
+	"0":        writeconcern.New(writeconcern.W(0)),
+	"1":        writeconcern.New(writeconcern.W(1)),
+	"majority": writeconcern.New(writeconcern.WMajority()),
+}
+
+// illegalOperationCode is returned by standalone servers for transactions.
+const illegalOperationCode = 20
+
+func isTransactionNotSupported(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.HasErrorCode(illegalOperationCode)
+}
+
+// InsertOptions controls how records are written.
+type InsertOptions struct {
+	Txn bool // Wrap the write in a transaction
+	// Dedup upserts on Record.SourceKey so re-imports are idempotent. Every
+	// record becomes an indexed lookup plus a write, which is noticeably
+	// slower than a plain InsertMany.
+	Dedup bool
+	// Strict fails instead of warning when a record nears the document size
+	// limit, see checkDocumentSizes.
+	Strict bool
+	// ShardKeyField stores a hashed shardKey derived from _id or this
+	// property before writing, see setShardKeys. Empty to skip.
+	ShardKeyField string
+}
+
+// maxDocumentSize is MongoDB's BSON document limit, checkDocumentSizes
+// warns past warnDocumentSize after marshaling up to sizeCheckSample records.
+const (
+	maxDocumentSize  = 16 * 1024 * 1024
+	warnDocumentSize = maxDocumentSize / 2
+	sizeCheckSample  = 1000
+)
+
+// checkDocumentSizes marshals an evenly spaced sample of records, levels
+// dominate and are the same size for every record, and reports the largest
+// over warnDocumentSize. It errors with strict or past the hard limit, so
+// oversized levels fail before the driver does.
+func checkDocumentSizes(records []Record, strict bool) error {
+	largest, largestSize := -1, 0
+	step := len(records)/sizeCheckSample + 1
+	for i := 0; i < len(records); i += step {
+		content, err := bson.Marshal(records[i])
+		if err != nil {
+			return fmt.Errorf("marshal record %d: %w", i, err)
+		}
+		if len(content) > largestSize {
+			largest, largestSize = i, len(content)
+		}
+	}
+	if largestSize <= warnDocumentSize {
+		return nil
+	}
+	msg := fmt.Sprintf("record %d is %d bytes, %d levels, MongoDB's limit is %d, narrow the zoom range or drop -store-tile-geometry",
+		largest, largestSize, len(records[largest].Levels), maxDocumentSize)
+	if strict || largestSize > maxDocumentSize {
+		return errors.New(msg)
+	}
+	log.Println("WARN", msg)
+	return nil
+}
+
+func writeRecords(ctx context.Context, collection *mongo.Collection, records []Record, dedup bool) error {
+	if !dedup {
+		repo, _ := xmongo.NewRepo[Record](collection)
+		_, err := repo.InsertMany(ctx, records)
+		return err
+	}
+	models := make([]mongo.WriteModel, len(records))
+	for i, record := range records {
+		filter := bson.M{"sourceKey": record.SourceKey}
+		if record.ShardKey != nil {
+			// Sharded upserts must target a single shard.
+			filter["shardKey"] = *record.ShardKey
+		}
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$setOnInsert": record}).
+			SetUpsert(true)
+	}
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// insertRecords inserts records, optionally inside a transaction so that
+// derived writes made in the same callback stay consistent with the source.
+// Standalone servers don't support transactions, in that case it logs a
+// warning and falls back to a plain insert.
+func insertRecords(ctx context.Context, client *mongo.Client, collection *mongo.Collection, records []Record, opts InsertOptions) error {
+	if opts.ShardKeyField != "" {
+		setShardKeys(records, opts.ShardKeyField)
+	}
+	if err := checkDocumentSizes(records, opts.Strict); err != nil {
+		return err
+	}
+	if !opts.Txn {
+		return writeRecords(ctx, collection, records, opts.Dedup)
+	}
+	err := client.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		_, err := sessCtx.WithTransaction(sessCtx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return nil, writeRecords(sessCtx, collection, records, opts.Dedup)
+		})
+		return err
+	})
+	if isTransactionNotSupported(err) {
+		log.Println("WARN transactions not supported by server, insert without transaction:", err.Error())
+		err = writeRecords(ctx, collection, records, opts.Dedup)
+	}
+	return err
+}
+
+func connect(ctx context.Context, uri string, maxPoolSize, minPoolSize uint64) (*mongo.Client, error) {
+	clientOpts := options.Client().
+		ApplyURI(uri).
+		SetMaxPoolSize(maxPoolSize).
+		SetMinPoolSize(minPoolSize)
+	return mongo.Connect(ctx, clientOpts)
+}
+
 func main() {
-	var needInsertData bool
-	var level int
-	flag.BoolVar(&needInsertData, "insert", false, "")
-	flag.IntVar(&level, "level", 12, "level to run aggregate")
+	var c cliFlags
+	registerFlags(&c)
+	flag.Usage = usage
 	flag.Parse()
+	var timings Timings
+	var badRows BadRows
+	if c.verbose {
+		// Deferred so every mode that returns early still reports its phases.
+		defer func() { log.Println("timings:", timings) }()
+	}
+	if err := validate(&c); err != nil {
+		log.Panicln(err)
+	}
+	opts, parseOpts, insertOpts := c.opts, c.parseOpts, c.insertOpts
+	var err error
+
+	runtimeCtx, stopWatchdog := withMaxRuntime(c.maxRuntime)
+	defer stopWatchdog()
+	defer recoverMaxRuntime(runtimeCtx, c.maxRuntime)
+
+	if c.demoCSV != "" {
+		exampleGeosCSV, err = os.ReadFile(c.demoCSV)
+		if err != nil {
+			log.Panicln("invalid -demo-csv", err.Error())
+		}
+	}
+
+	if c.selfTestPoints > 0 {
+		if selfTest(runtimeCtx, c.selfTestPoints, 1) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if c.checkPyramidDir != "" {
+		if !checkPyramidDemo(c.checkPyramidDir) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if c.readStdin {
+		malformed, err := writePointKeys(os.Stdin, os.Stdout, storedZoom(c.level, opts))
+		if err != nil {
+			panic(err)
+		}
+		if malformed > 0 {
+			log.Println("skipped malformed lines:", malformed)
+			os.Exit(1)
+		}
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if c.dump {
+		if err := dumpPipeline(os.Stdout, c.level, opts, opts.Indent); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if c.reset {
+		if !c.assumeYes && !confirm(fmt.Sprintf("Drop collection %s.%s?", databaseName, collectionName)) {
+			log.Println("reset aborted")
+			return
+		}
+		c.needInsertData = true
+	}
+
+	// The per-phase timeout, -max-runtime still applies.
+	ctx, cancel := context.WithTimeout(runtimeCtx, 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		panic(err)
+	if c.geocodeQuery != "" {
+		locateDemo(ctx, StubGeocoder{}, c.geocodeQuery, opts)
+		return
 	}
 
-	err = client.Connect(ctx)
+	client, err := connect(ctx, c.uri, c.maxPoolSize, c.minPoolSize)
 	if err != nil {
 		panic(err)
 	}
+	defer client.Disconnect(context.Background())
+	readClient := client
+	if c.readURI != "" && c.readURI != c.uri {
+		readClient, err = connect(ctx, c.readURI, c.maxPoolSize, c.minPoolSize)
+		if err != nil {
+			panic(err)
+		}
+		defer readClient.Disconnect(context.Background())
+	}
 	collection := client.Database(databaseName).Collection(collectionName)
-	repo, _ := xmongo.NewRepo[Record](collection)
+	repo, _ := xmongo.NewRepo[Record](readClient.Database(databaseName).Collection(collectionName))
 
-	if needInsertData {
-		demos := SetupDemoData()
-		_, err := repo.InsertMany(ctx, demos)
+	// -shard-key-field only makes sense for a collection sharded, by now or
+	// a previous -shard.
+	indexShardField := ""
+	if c.shard || insertOpts.ShardKeyField != "" {
+		indexShardField = shardField(insertOpts.ShardKeyField != "")
+	}
+	if c.reset {
+		if err := resetCollection(ctx, collection, indexShardField); err != nil {
+			panic(err)
+		}
+	}
+	if c.shard {
+		if err := shardCollection(ctx, client, collection, insertOpts.ShardKeyField != ""); err != nil {
+			panic(err)
+		}
+		log.Println("sharded", databaseName+"."+collectionName)
+	}
+	if c.benchmarkPoints > 0 {
+		// Inserting and timing every scheme outlasts the per-phase timeout.
+		benchmarkDemo(runtimeCtx, client, databaseName, collectionName, c.benchmarkPoints, c.level, opts)
+		return
+	}
+	// Every insert goes through -write-concern.
+	insertCollection := client.Database(databaseName).Collection(collectionName, options.Collection().SetWriteConcern(c.wc))
+	if c.needInsertData {
+		parseOpts.Timings = &timings
+		parseOpts.BadRows = &badRows
+		if c.rejectPath != "" {
+			rejectFile, err := os.Create(c.rejectPath)
+			if err != nil {
+				panic(err)
+			}
+			defer rejectFile.Close()
+			parseOpts.Rejects, err = NewRejectFile(rejectFile)
+			if err != nil {
+				panic(err)
+			}
+		}
+		start := time.Now()
+		var demos []Record
+		var failed int
+		if c.input != "" {
+			demos, failed, err = LoadInput(c.input, c.gzipInput, parseOpts)
+		} else {
+			demos, failed, err = SetupDemoData(parseOpts)
+		}
+		if parseOpts.Rejects != nil {
+			// Flushed before failing too, so -on-error fail still leaves
+			// the c.row it stopped at.
+			if err := parseOpts.Rejects.Flush(); err != nil {
+				panic(err)
+			}
+			log.Printf("wrote %d rejected rows to %s", parseOpts.Rejects.Count, c.rejectPath)
+		}
 		if err != nil {
 			panic(err)
 		}
+		timings.Parse = time.Since(start) - timings.SetLevels
+		if failed > 0 {
+			log.Println("skipped invalid rows:", failed)
+			for _, row := range badRows {
+				log.Println("  skipped", row)
+			}
+		}
+		if insertOpts.Dedup || parseOpts.TileGeometry {
+			if err := EnsureIndexes(ctx, collection, indexShardField); err != nil {
+				panic(err)
+			}
+		}
+		start = time.Now()
+		if c.checkpointPath != "" {
+			// Checkpointed imports are the long ones, past the per-phase
+			// timeout.
+			err = insertCheckpointed(runtimeCtx, client, insertCollection, demos, insertOpts, c.checkpointPath, c.resume)
+		} else {
+			err = insertRecords(ctx, client, insertCollection, demos, insertOpts)
+		}
+		if err != nil {
+			panic(err)
+		}
+		timings.Insert = time.Since(start)
+	}
+	if c.seedDemo {
+		seeds := SeedDemoData(parseOpts)
+		if err := insertRecords(ctx, client, insertCollection, seeds, insertOpts); err != nil {
+			panic(err)
+		}
+		log.Println("inserted seed records:", len(seeds))
 	}
 
-	demo(ctx, repo, level)
+	if c.baselineCollection != "" {
+		baselineRepo, _ := xmongo.NewRepo[Record](readClient.Database(databaseName).Collection(c.baselineCollection))
+		opts.Baseline, err = baselineFromCollection(ctx, baselineRepo, c.level, opts)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if c.estimateSample > 0 {
+		estimateDemo(ctx, repo, c.estimateSample)
+		return
+	}
+	if c.verify {
+		checked, mismatched, err := verifyLevels(ctx, repo, c.verifySample)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("checked %d records, %d mismatched\n", checked, mismatched)
+		return
+	}
+	if c.serveAddr != "" {
+		panic(serve(c.serveAddr, repo, readClient.Database(databaseName).Collection(collectionName), c.level, opts))
+	}
+	if c.followInterval > 0 {
+		if err := follow(repo, c.level, c.followInterval, opts); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if c.nearest != "" {
+		nearestDemo(ctx, repo, c.level, c.nearestQuery, opts)
+		return
+	}
+	if c.facetTop > 0 {
+		boundaries := defaultFacetBoundaries
+		if c.binBoundaries != nil {
+			boundaries = c.binBoundaries
+		}
+		facetDemo(ctx, repo, c.level, c.facetTop, boundaries, opts)
+		return
+	}
+	if c.binBoundaries != nil {
+		binDemo(ctx, repo, c.level, c.binBoundaries, opts)
+		return
+	}
+	if c.pyramid {
+		pyramidDemo(ctx, repo, c.level, opts)
+		return
+	}
+	if c.blendLevel >= 0 {
+		blendDemo(ctx, repo, c.blendLevel, opts)
+		return
+	}
+	if c.collections != "" {
+		db := readClient.Database(databaseName)
+		names, err := resolveCollections(ctx, db, c.collections)
+		if err != nil {
+			panic(err)
+		}
+		collectionsDemo(ctx, db, names, c.level, opts, c.reportCollections, c.unionWith)
+		return
+	}
+	if opts.Format == "mbtiles" {
+		// Every zoom is an aggregation, past the per-phase timeout.
+		tiles, err := writeMBTiles(runtimeCtx, repo, c.outPath, c.mbtilesLo, c.mbtilesHi, opts)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("wrote %d tiles to %s", tiles, c.outPath)
+		return
+	}
+	if c.ndjsonFile != "" {
+		// Exports can run far past the per-phase timeout.
+		lines, err := exportNDJSON(runtimeCtx, repo, c.level, opts, c.ndjsonFile)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("wrote %d lines to %s", lines, c.ndjsonFile)
+		return
+	}
+	start := time.Now()
+	if opts.Ring != nil {
+		ringDemo(ctx, repo, c.level, opts)
+	} else {
+		demo(ctx, repo, c.level, opts)
+	}
+	timings.Aggregate = time.Since(start)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parseMask reads a Polygon or MultiPolygon from inline GeoJSON, starting
+// with `{`, or from a file. Geometries, Features and the first feature of a
+// FeatureCollection are accepted.
+func parseMask(raw string) (orb.Geometry, error) {
+	content := []byte(raw)
+	if !strings.HasPrefix(strings.TrimSpace(raw), "{") {
+		var err error
+		content, err = os.ReadFile(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var geometry orb.Geometry
+	if fc, err := geojson.UnmarshalFeatureCollection(content); err == nil && fc.Type == "FeatureCollection" {
+		if len(fc.Features) == 0 {
+			return nil, fmt.Errorf("feature collection is empty")
+		}
+		geometry = fc.Features[0].Geometry
+	} else if feature, err := geojson.UnmarshalFeature(content); err == nil && feature.Type == "Feature" {
+		geometry = feature.Geometry
+	} else {
+		g, err := geojson.UnmarshalGeometry(content)
+		if err != nil {
+			return nil, fmt.Errorf("not GeoJSON: %w", err)
+		}
+		geometry = g.Geometry()
+	}
+	switch g := geometry.(type) {
+	case orb.Polygon:
+		return g, validatePolygon(g)
+	case orb.MultiPolygon:
+		for i, polygon := range g {
+			if err := validatePolygon(polygon); err != nil {
+				return nil, fmt.Errorf("polygon %d: %w", i, err)
+			}
+		}
+		return g, nil
+	default:
+		return nil, fmt.Errorf("need a Polygon or MultiPolygon, got %T", geometry)
+	}
+}
+
+// validatePolygon checks rings are closed and oriented as RFC 7946 requires,
+// exterior counterclockwise and holes clockwise.
+func validatePolygon(polygon orb.Polygon) error {
+	if len(polygon) == 0 {
+		return fmt.Errorf("polygon has no rings")
+	}
+	for i, ring := range polygon {
+		if len(ring) < 4 {
+			return fmt.Errorf("ring %d has %d points, needs at least 4", i, len(ring))
+		}
+		if !ring.Closed() {
+			return fmt.Errorf("ring %d is not closed, first point %v, last %v", i, ring[0], ring[len(ring)-1])
+		}
+		want, name := orb.CW, "clockwise"
+		if i == 0 {
+			want, name = orb.CCW, "counterclockwise"
+		}
+		if ring.Orientation() != want {
+			return fmt.Errorf("ring %d must be %s", i, name)
+		}
+	}
+	return nil
+}
+
+// maskMatch selects records whose location is within mask.
+func maskMatch(mask orb.Geometry) bson.M {
+	return bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": mask.GeoJSONType(), "coordinates": mask}}}
+}
+
+// Circle is a -circle filter, Radius in meters.
+type Circle struct {
+	Center orb.Point
+	Radius float64
+}
+
+// parseCircle parses `lng,lat,radiusMeters`.
+func parseCircle(raw string) (Circle, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 3 {
+		return Circle{}, fmt.Errorf("circle must be lng,lat,radiusMeters, got %q", raw)
+	}
+	var values [3]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Circle{}, fmt.Errorf("invalid circle value %q", part)
+		}
+		values[i] = v
+	}
+	circle := Circle{Center: orb.Point{values[0], values[1]}, Radius: values[2]}
+	if circle.Center.Lon() < -180 || circle.Center.Lon() > 180 || circle.Center.Lat() < -90 || circle.Center.Lat() > 90 {
+		return Circle{}, fmt.Errorf("circle center %v out of range", circle.Center)
+	}
+	if !(circle.Radius > 0) {
+		return Circle{}, fmt.Errorf("circle radius must be positive, got %v", circle.Radius)
+	}
+	return circle, nil
+}
+
+// circleMatch selects records whose location is within circle, $centerSphere
+// takes the radius in radians.
+func circleMatch(circle Circle) bson.M {
+	return bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{circle.Center.Lon(), circle.Center.Lat()}, circle.Radius / earthRadius}}}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// mbtilesSchema is the MBTiles 1.3 schema, the unique index lets readers
+// look tiles up without a scan.
+const mbtilesSchema = `
+CREATE TABLE metadata (name text, value text);
+CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// parseZoomRange parses `min-max`, both within the indexed levels.
+func parseZoomRange(raw string) (lo, hi int, err error) {
+	parts := strings.Split(raw, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("zoom range must be min-max, got %q", raw)
+	}
+	lo, errLo := strconv.Atoi(strings.TrimSpace(parts[0]))
+	hi, errHi := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errLo != nil || errHi != nil || lo < minZoom || hi > maxZoom || lo > hi {
+		return 0, 0, fmt.Errorf("zoom range must be min-max within [%d, %d], got %q", minZoom, maxZoom, raw)
+	}
+	return lo, hi, nil
+}
+
+// gzipBytes compresses data, MBTiles readers expect gzipped pbf tiles.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMBTiles writes the MVT of every non-empty tile from zoom lo to hi into
+// a new MBTiles file at path, replacing it, and returns the tile count.
+//
+// Tiles match /tiles: each shows the cells mvtDetail levels finer, so every
+// zoom takes one aggregation of that level, split into tiles in Go, rather
+// than one per tile. Rows are flipped to TMS as the spec requires.
+func writeMBTiles(ctx context.Context, repo RecordRepo, path string, lo, hi int, opts Options) (int, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, mbtilesSchema); err != nil {
+		return 0, fmt.Errorf("create schema: %w", err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	opts.Within = ""
+	aggregated := make(map[int][]RawStats)
+	written := 0
+	for z := lo; z <= hi; z++ {
+		_, level, _ := mvtSource(maptile.New(0, 0, maptile.Zoom(z)), 0)
+		// Cells are keyed at the stored zoom, tiles can only be coarser.
+		stored := storedZoom(level, opts)
+		if stored < z {
+			return written, fmt.Errorf("zoom %d: cells are stored at zoom %d, reduce -zoom-offset", z, stored)
+		}
+		stats, ok := aggregated[level]
+		if !ok {
+			stats, err = aggregate(ctx, repo, level, opts)
+			if err != nil {
+				return written, fmt.Errorf("zoom %d: %w", z, err)
+			}
+			aggregated[level] = stats
+		}
+		byTile := make(map[maptile.Tile][]RawStats)
+		for _, item := range stats {
+			cell, err := ParseTileKey(item.ID)
+			if err != nil {
+				return written, err
+			}
+			shift := uint32(stored - z)
+			tile := maptile.New(cell.X>>shift, cell.Y>>shift, maptile.Zoom(z))
+			byTile[tile] = append(byTile[tile], item)
+		}
+		tiles := make([]maptile.Tile, 0, len(byTile))
+		for tile := range byTile {
+			tiles = append(tiles, tile)
+		}
+		sort.Slice(tiles, func(i, j int) bool {
+			return tiles[i].X < tiles[j].X || tiles[i].X == tiles[j].X && tiles[i].Y < tiles[j].Y
+		})
+		for _, tile := range tiles {
+			data, err := encodeMVT(tile, byTile[tile], opts)
+			if err != nil {
+				return written, fmt.Errorf("encode %v: %w", tile, err)
+			}
+			if data, err = gzipBytes(data); err != nil {
+				return written, err
+			}
+			row := (uint32(1) << tile.Z) - 1 - tile.Y
+			if _, err := insert.ExecContext(ctx, z, tile.X, row, data); err != nil {
+				return written, fmt.Errorf("insert %v: %w", tile, err)
+			}
+			written++
+		}
+	}
+
+	fields := map[string]string{"count": "Number", "tileKey": "String"}
+	if opts.ClampCount > 0 {
+		fields["rawCount"] = "Number"
+	}
+	layers, err := json.Marshal(map[string]interface{}{
+		"vector_layers": []map[string]interface{}{{"id": mvtLayerName, "fields": fields, "minzoom": lo, "maxzoom": hi}},
+	})
+	if err != nil {
+		return written, err
+	}
+	// Bounds from the finest cells written, coarser ones overstate them.
+	_, finest, _ := mvtSource(maptile.New(0, 0, maptile.Zoom(hi)), 0)
+	var bound orb.Bound
+	for i, item := range aggregated[finest] {
+		cell, _ := ParseTileKey(item.ID)
+		if i == 0 {
+			bound = cell.Bound()
+		}
+		bound = bound.Union(cell.Bound())
+	}
+	center := bound.Center()
+	metadata := [][2]string{
+		{"name", opts.Source},
+		{"format", "pbf"},
+		{"type", "overlay"},
+		{"version", "1"},
+		{"description", "Record counts per tile of " + opts.Source},
+		{"minzoom", strconv.Itoa(lo)},
+		{"maxzoom", strconv.Itoa(hi)},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", bound.Min.Lon(), bound.Min.Lat(), bound.Max.Lon(), bound.Max.Lat())},
+		{"center", fmt.Sprintf("%f,%f,%d", center.Lon(), center.Lat(), lo)},
+		{"json", string(layers)},
+	}
+	for _, row := range metadata {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO metadata (name, value) VALUES (?, ?)", row[0], row[1]); err != nil {
+			return written, fmt.Errorf("insert metadata %s: %w", row[0], err)
+		}
+	}
+	return written, tx.Commit()
+}
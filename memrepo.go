@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecordRepo is what the aggregations need from a collection. xmongo.Repo
+// is the production implementation, MemoryRepo runs without MongoDB.
+type RecordRepo interface {
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	InsertOne(ctx context.Context, doc Record, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+}
+
+// MemoryRepo keeps records in memory and evaluates the pipelines built by
+// buildPipeline in Go: $match with equality, $gte, $lte, $in and regexes,
+// $unwind, $group with $sum, $avg and $addToSet, $addFields, $project
+// exclusions, $sort and $count. Other stages and operators, like $geoWithin
+// or $search, error. It's meant for tests of the aggregation and conversion
+// logic.
+type MemoryRepo struct {
+	mu   sync.Mutex
+	docs []map[string]interface{}
+}
+
+// NewMemoryRepo stores records as their BSON encoding would.
+func NewMemoryRepo(records []Record) (*MemoryRepo, error) {
+	repo := &MemoryRepo{}
+	for _, record := range records {
+		if _, err := repo.InsertOne(context.Background(), record); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+func (m *MemoryRepo) InsertOne(ctx context.Context, doc Record, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	content, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var raw bson.D
+	if err := bson.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs = append(m.docs, normalizeValue(raw).(map[string]interface{}))
+	return &mongo.InsertOneResult{InsertedID: doc.ID}, nil
+}
+
+func (m *MemoryRepo) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	stages, ok := normalizeValue(pipeline).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("memory repo: pipeline must be an array, got %T", pipeline)
+	}
+	m.mu.Lock()
+	docs := append([]map[string]interface{}{}, m.docs...)
+	m.mu.Unlock()
+	docs, err := applyStages(stages, docs)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		res[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(res, nil, nil)
+}
+
+func applyStages(stages []interface{}, docs []map[string]interface{}) ([]map[string]interface{}, error) {
+	for _, raw := range stages {
+		stage, ok := raw.(map[string]interface{})
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("memory repo: invalid stage %v", raw)
+		}
+		var err error
+		for name, spec := range stage {
+			docs, err = applyStage(name, spec, docs)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func applyStage(name string, spec interface{}, docs []map[string]interface{}) ([]map[string]interface{}, error) {
+	switch name {
+	case "$match":
+		filter, _ := spec.(map[string]interface{})
+		res := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			ok, err := matches(doc, filter)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				res = append(res, doc)
+			}
+		}
+		return res, nil
+	case "$unwind":
+		path, _ := spec.(string)
+		path = strings.TrimPrefix(path, "$")
+		res := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			values, _ := doc[path].([]interface{})
+			for _, value := range values {
+				unwound := copyDoc(doc)
+				unwound[path] = value
+				res = append(res, unwound)
+			}
+		}
+		return res, nil
+	case "$group":
+		group, _ := spec.(map[string]interface{})
+		return groupDocs(group, docs)
+	case "$addFields":
+		fields, _ := spec.(map[string]interface{})
+		res := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			added := copyDoc(doc)
+			for field, expr := range fields {
+				value, err := evaluate(expr, doc)
+				if err != nil {
+					return nil, err
+				}
+				added[field] = value
+			}
+			res = append(res, added)
+		}
+		return res, nil
+	case "$project":
+		fields, _ := spec.(map[string]interface{})
+		for field, v := range fields {
+			if !isProjectFlag(v, false) {
+				return nil, fmt.Errorf("memory repo: only $project exclusions are supported, got %s: %v", field, v)
+			}
+		}
+		res := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			projected := copyDoc(doc)
+			for field := range fields {
+				delete(projected, field)
+			}
+			res = append(res, projected)
+		}
+		return res, nil
+	case "$sort":
+		keys, _ := spec.([]interface{})
+		sort.SliceStable(docs, func(i, j int) bool {
+			for _, raw := range keys {
+				key := raw.([2]interface{})
+				c := compareValues(lookupFirst(docs[i], key[0].(string)), lookupFirst(docs[j], key[0].(string)))
+				if c != 0 {
+					return (c < 0) == (toFloat(key[1]) > 0)
+				}
+			}
+			return false
+		})
+		return docs, nil
+	case "$count":
+		field, _ := spec.(string)
+		return []map[string]interface{}{{field: int32(len(docs))}}, nil
+	}
+	return nil, fmt.Errorf("memory repo: unsupported stage %s", name)
+}
+
+// copyDoc copies the top level of doc, stages that change fields work on a
+// copy so the stored documents stay as inserted.
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(doc)+1)
+	for k, v := range doc {
+		copied[k] = v
+	}
+	return copied
+}
+
+func groupDocs(group map[string]interface{}, docs []map[string]interface{}) ([]map[string]interface{}, error) {
+	type state struct {
+		doc    map[string]interface{}
+		counts map[string]int
+		sets   map[string]map[string]bool
+	}
+	groups := make(map[string]*state)
+	order := make([]string, 0)
+	averages := make(map[string]bool)
+	for _, doc := range docs {
+		id, err := evaluate(group["_id"], doc)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprint(id)
+		g, ok := groups[key]
+		if !ok {
+			g = &state{doc: map[string]interface{}{"_id": id}, counts: map[string]int{}, sets: map[string]map[string]bool{}}
+			groups[key] = g
+			order = append(order, key)
+		}
+		for field, raw := range group {
+			if field == "_id" {
+				continue
+			}
+			accumulator, _ := raw.(map[string]interface{})
+			for op, expr := range accumulator {
+				if op != "$sum" && op != "$avg" && op != "$addToSet" {
+					return nil, fmt.Errorf("memory repo: unsupported accumulator %s", op)
+				}
+				value, err := evaluate(expr, doc)
+				if err != nil {
+					return nil, err
+				}
+				if op == "$addToSet" {
+					addToSet(g.doc, g.sets, field, value)
+					continue
+				}
+				averages[field] = op == "$avg"
+				if _, ok := value.(float64); !ok {
+					continue
+				}
+				total, _ := g.doc[field].(float64)
+				g.doc[field] = total + value.(float64)
+				g.counts[field]++
+			}
+		}
+	}
+	res := make([]map[string]interface{}, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		for field, average := range averages {
+			if n := g.counts[field]; average && n > 0 {
+				g.doc[field] = g.doc[field].(float64) / float64(n)
+			} else if !average && n == 0 {
+				g.doc[field] = 0.0
+			}
+		}
+		res = append(res, g.doc)
+	}
+	return res, nil
+}
+
+// addToSet appends value to the doc[field] array unless it's already there,
+// missing values are skipped like MongoDB does.
+func addToSet(doc map[string]interface{}, sets map[string]map[string]bool, field string, value interface{}) {
+	values, _ := doc[field].([]interface{})
+	if values == nil {
+		values = []interface{}{}
+		sets[field] = map[string]bool{}
+	}
+	if key := fmt.Sprintf("%T:%v", value, value); value != nil && !sets[field][key] {
+		sets[field][key] = true
+		values = append(values, value)
+	}
+	doc[field] = values
+}
+
+// regexMatch applies a BSON regex, supporting the i, m and s options.
+func regexMatch(regex primitive.Regex, s string) bool {
+	flags := ""
+	for _, option := range regex.Options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		flags = "(?" + flags + ")"
+	}
+	re, err := regexp.Compile(flags + regex.Pattern)
+	return err == nil && re.MatchString(s)
+}
+
+// isProjectFlag reports if v is a $project inclusion, true or 1, or an
+// exclusion, false or 0, as on says.
+func isProjectFlag(v interface{}, on bool) bool {
+	if b, ok := v.(bool); ok {
+		return b == on
+	}
+	return isNumber(v) && (toFloat(v) != 0) == on
+}
+
+// isNumber reports if v is one of the numeric types toFloat converts.
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, uint32, float32, float64:
+		return true
+	}
+	return false
+}
+
+// evaluate computes an aggregation expression: field paths, literals,
+// $ifNull, $arrayElemAt, $size and $split.
+func evaluate(expr interface{}, doc map[string]interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			return lookupFirst(doc, e[1:]), nil
+		}
+		return e, nil
+	case map[string]interface{}:
+		for op, raw := range e {
+			args, _ := raw.([]interface{})
+			switch op {
+			case "$ifNull":
+				for _, arg := range args {
+					v, err := evaluate(arg, doc)
+					if err != nil || v != nil {
+						return v, err
+					}
+				}
+				return nil, nil
+			case "$size":
+				v, err := evaluate(raw, doc)
+				if err != nil {
+					return nil, err
+				}
+				values, ok := v.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("memory repo: $size needs an array")
+				}
+				return int32(len(values)), nil
+			case "$arrayElemAt":
+				if len(args) != 2 {
+					return nil, fmt.Errorf("memory repo: $arrayElemAt needs 2 arguments")
+				}
+				v, err := evaluate(args[0], doc)
+				if err != nil {
+					return nil, err
+				}
+				values, _ := v.([]interface{})
+				i := int(toFloat(args[1]))
+				if i < 0 || i >= len(values) {
+					return nil, nil
+				}
+				return values[i], nil
+			case "$split":
+				if len(args) != 2 {
+					return nil, fmt.Errorf("memory repo: $split needs 2 arguments")
+				}
+				v, err := evaluate(args[0], doc)
+				if err != nil {
+					return nil, err
+				}
+				s, ok := v.(string)
+				if !ok {
+					return nil, nil
+				}
+				parts := make([]interface{}, 0)
+				for _, part := range strings.Split(s, args[1].(string)) {
+					parts = append(parts, part)
+				}
+				return parts, nil
+			}
+			return nil, fmt.Errorf("memory repo: unsupported expression %s", op)
+		}
+	}
+	return expr, nil
+}
+
+// matches evaluates a $match filter against doc.
+func matches(doc map[string]interface{}, filter map[string]interface{}) (bool, error) {
+	for path, condition := range filter {
+		values := lookup(doc, path)
+		operators, isOperators := condition.(map[string]interface{})
+		if isOperators {
+			for op := range operators {
+				isOperators = isOperators && strings.HasPrefix(op, "$")
+			}
+		}
+		if !isOperators {
+			if !anyValue(values, func(v interface{}) bool { return equalValues(v, condition) }) {
+				return false, nil
+			}
+			continue
+		}
+		for op, arg := range operators {
+			var ok bool
+			switch op {
+			case "$gte":
+				ok = anyValue(values, func(v interface{}) bool { return compareValues(v, arg) >= 0 })
+			case "$lte":
+				ok = anyValue(values, func(v interface{}) bool { return compareValues(v, arg) <= 0 })
+			case "$in":
+				candidates, _ := arg.([]interface{})
+				ok = anyValue(values, func(v interface{}) bool {
+					return anyValue(candidates, func(c interface{}) bool { return equalValues(v, c) })
+				})
+			default:
+				return false, fmt.Errorf("memory repo: unsupported operator %s on %s", op, path)
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func anyValue(values []interface{}, f func(interface{}) bool) bool {
+	for _, v := range values {
+		if f(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves a dotted path like MongoDB, descending into every element
+// of arrays on the way. Numeric parts index arrays.
+func lookup(value interface{}, path string) []interface{} {
+	if path == "" {
+		return []interface{}{value}
+	}
+	part, rest, _ := strings.Cut(path, ".")
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[part]
+		if !ok {
+			return nil
+		}
+		if rest == "" {
+			if values, ok := child.([]interface{}); ok {
+				return append([]interface{}{child}, values...)
+			}
+			return []interface{}{child}
+		}
+		return lookup(child, rest)
+	case []interface{}:
+		var i int
+		if _, err := fmt.Sscanf(part, "%d", &i); err == nil && fmt.Sprint(i) == part {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookup(v[i], rest)
+		}
+		res := make([]interface{}, 0)
+		for _, element := range v {
+			res = append(res, lookup(element, path)...)
+		}
+		return res
+	}
+	return nil
+}
+
+// lookupFirst is the value of a dotted path without array expansion.
+func lookupFirst(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[part]
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(part, "%d", &i); err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// normalizeValue turns BSON documents into maps, arrays into slices, bson.D
+// sort specs into ordered pairs and numbers into float64.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		if isSortSpec(v) {
+			pairs := make([]interface{}, len(v))
+			for i, e := range v {
+				pairs[i] = [2]interface{}{e.Key, normalizeValue(e.Value)}
+			}
+			return pairs
+		}
+		res := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			res[e.Key] = normalizeValue(e.Value)
+		}
+		return res
+	case bson.M:
+		return normalizeValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[k] = normalizeValue(e)
+		}
+		return res
+	case primitive.A:
+		return normalizeValue([]interface{}(v))
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = normalizeValue(e)
+		}
+		return res
+	case primitive.DateTime:
+		return v.Time()
+	case int, int32, int64, uint32, float32:
+		return toFloat(v)
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+		res := make([]interface{}, rv.Len())
+		for i := range res {
+			res[i] = normalizeValue(rv.Index(i).Interface())
+		}
+		return res
+	}
+	return value
+}
+
+// isSortSpec reports whether d looks like a $sort spec, every value 1 or -1.
+func isSortSpec(d bson.D) bool {
+	for _, e := range d {
+		if n := toFloat(e.Value); n != 1 && n != -1 {
+			return false
+		}
+	}
+	return len(d) > 0
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func equalValues(a, b interface{}) bool {
+	if regex, ok := b.(primitive.Regex); ok {
+		s, isString := a.(string)
+		return isString && regexMatch(regex, s)
+	}
+	return compareValues(a, b) == 0 && reflect.TypeOf(a) == reflect.TypeOf(b)
+}
+
+// compareValues orders numbers, strings and times, mismatched types compare
+// by type name.
+func compareValues(a, b interface{}) int {
+	if isNumber(a) && isNumber(b) {
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	case nil:
+		if b == nil {
+			return 0
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const memoryTestLevel = 12
+
+func newSeedRepo(t *testing.T) (*MemoryRepo, []Record) {
+	t.Helper()
+	records := SeedDemoData(ParseOptions{})
+	repo, err := NewMemoryRepo(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, records
+}
+
+// TestMemoryAggregate aggregates the seed records through MemoryRepo and
+// compares the counts with their stored levels, counted in Go.
+func TestMemoryAggregate(t *testing.T) {
+	repo, records := newSeedRepo(t)
+	want := make(map[string]int)
+	for _, record := range records {
+		want[expandKey(record.Levels[memoryTestLevel-minZoom].Key)]++
+	}
+	opts := Options{Sort: "count", Geometry: "centroid"}
+	stats, err := aggregate(context.Background(), repo, memoryTestLevel, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("%d tiles, expected %d", len(stats), len(want))
+	}
+	for i, item := range stats {
+		if item.Count != want[item.ID] {
+			t.Errorf("tile %s has count %d, expected %d", item.ID, item.Count, want[item.ID])
+		}
+		if i > 0 && item.Count > stats[i-1].Count {
+			t.Errorf("not sorted by count at %s", item.ID)
+		}
+		if item.Lng == nil || item.Lat == nil {
+			t.Errorf("tile %s has no centroid", item.ID)
+		}
+	}
+	fc := toFeatureCollection(stats, opts)
+	if count := fc.Features[0].Properties["count"]; count != stats[0].Count {
+		t.Errorf("feature count %v, expected %d", count, stats[0].Count)
+	}
+}
+
+// TestMemoryAggregateOptions runs buildPipeline variants through MemoryRepo
+// and compares the total count with the records they should keep.
+func TestMemoryAggregateOptions(t *testing.T) {
+	repo, records := newSeedRepo(t)
+	largest := make(map[string]int)
+	for _, record := range records {
+		largest[record.Levels[memoryTestLevel-minZoom].Key]++
+	}
+	floor, atFloor := 0, 0
+	for _, count := range largest {
+		if count > floor {
+			floor, atFloor = count, 0
+		}
+		if count == floor {
+			atFloor++
+		}
+	}
+	// Only the Statue of Liberty.
+	liberty := orb.Bound{Min: orb.Point{-74.05, 40.68}, Max: orb.Point{-74.04, 40.70}}
+	tests := []struct {
+		name  string
+		opts  Options
+		count int
+		tiles int
+	}{
+		{"all", Options{}, len(records), len(largest)},
+		{"min count", Options{MinCount: MinCounts{Default: floor}}, floor * atFloor, atFloor},
+		{"sorted by key", Options{Sort: "key"}, len(records), len(largest)},
+		{"bbox", Options{BBox: &liberty}, 1, 1},
+		{"distinct", Options{DistinctField: "name"}, len(records), len(largest)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := aggregate(context.Background(), repo, memoryTestLevel, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := totalCount(stats); got != tt.count {
+				t.Errorf("total count %d, expected %d", got, tt.count)
+			}
+			if len(stats) != tt.tiles {
+				t.Errorf("%d tiles, expected %d", len(stats), tt.tiles)
+			}
+			if tt.opts.DistinctField != "" {
+				for _, item := range stats {
+					if item.DeviceCount == nil || *item.DeviceCount != item.Count {
+						t.Errorf("tile %s has deviceCount %v, expected %d", item.ID, item.DeviceCount, item.Count)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMemoryRepoKeepsDocs checks stages writing fields don't change the
+// stored documents seen by later aggregations.
+func TestMemoryRepoKeepsDocs(t *testing.T) {
+	repo, records := newSeedRepo(t)
+	ctx := context.Background()
+	if _, err := repo.Aggregate(ctx, bson.A{
+		bson.M{"$addFields": bson.M{"added": "$properties.name"}},
+		bson.M{"$project": bson.M{"levels": 0}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := repo.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"levels.z": memoryTestLevel}},
+		bson.M{"$count": "count"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []bson.M
+	if err := cursor.All(ctx, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0]["count"] != int32(len(records)) {
+		t.Fatalf("got %v, expected a count of %d", res, len(records))
+	}
+	for _, doc := range repo.docs {
+		if _, ok := doc["added"]; ok {
+			t.Fatal("$addFields changed a stored document")
+		}
+	}
+}
+
+// TestMemoryRepoUnsupported checks stages buildPipeline doesn't emit error
+// instead of being ignored.
+func TestMemoryRepoUnsupported(t *testing.T) {
+	repo, _ := newSeedRepo(t)
+	for _, pipeline := range []bson.A{
+		{bson.M{"$limit": 1}},
+		{bson.M{"$project": bson.M{"name": 1}}},
+		{bson.M{"$match": bson.M{"location": bson.M{"$geoWithin": bson.M{}}}}},
+	} {
+		if _, err := repo.Aggregate(context.Background(), pipeline); err == nil {
+			t.Errorf("%v: expected an error", pipeline)
+		}
+	}
+}
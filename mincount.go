@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinCounts are the -min-count floors tiles must reach to be emitted. A zoom
+// without its own uses the one of the closest coarser zoom listed, Default
+// below all of them.
+type MinCounts struct {
+	Default int
+	Zooms   map[int]int
+}
+
+// parseMinCounts parses a count for every zoom, `z:count` pairs like
+// `8:2,10:5,12:10`, or both as in `2,12:10`.
+func parseMinCounts(raw string) (MinCounts, error) {
+	res := MinCounts{Zooms: make(map[int]int)}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		zoom, value, perZoom := strings.Cut(part, ":")
+		if !perZoom {
+			value = zoom
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || count < 0 {
+			return MinCounts{}, fmt.Errorf("invalid count in %q", part)
+		}
+		if !perZoom {
+			res.Default = count
+			continue
+		}
+		z, err := strconv.Atoi(strings.TrimSpace(zoom))
+		if err != nil || z < minZoom || z > maxZoom {
+			return MinCounts{}, fmt.Errorf("zoom in %q must be in [%d, %d]", part, minZoom, maxZoom)
+		}
+		res.Zooms[z] = count
+	}
+	return res, nil
+}
+
+// At returns the floor of zoom z.
+func (m MinCounts) At(z int) int {
+	for ; z >= minZoom; z-- {
+		if count, ok := m.Zooms[z]; ok {
+			return count
+		}
+	}
+	return m.Default
+}
+
+// minCountFloor is the floor of the tiles aggregated at level, Default for
+// grid cells which have no zoom.
+func minCountFloor(level int, opts Options) int {
+	if opts.GridSize > 0 {
+		return opts.MinCount.Default
+	}
+	return opts.MinCount.At(storedZoom(level, opts))
+}
+
+// filterMinCount drops the stats below floor, for counts summed in Go where
+// the pipeline couldn't filter.
+func filterMinCount(stats []RawStats, floor int) []RawStats {
+	res := stats[:0]
+	for _, item := range stats {
+		if item.Count >= floor {
+			res = append(res, item)
+		}
+	}
+	return res
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	mvtLayerName = "tiles"
+
+	// Each MVT shows the aggregation mvtDetail levels below it, 8x8 cells.
+	mvtDetail = 3
+)
+
+// parseTilePath parses `/tiles/{z}/{x}/{y}.mvt`.
+func parseTilePath(path string) (maptile.Tile, error) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(path, "/tiles/"), ".mvt")
+	parts := strings.Split(trimmed, "/")
+	if len(parts) != 3 {
+		return maptile.Tile{}, fmt.Errorf("path must be /tiles/{z}/{x}/{y}.mvt, got %q", path)
+	}
+	var zxy [3]uint32
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return maptile.Tile{}, fmt.Errorf("invalid tile path %q", path)
+		}
+		zxy[i] = uint32(v)
+	}
+	tile := maptile.New(zxy[1], zxy[2], maptile.Zoom(zxy[0]))
+	if !tile.Valid() {
+		return maptile.Tile{}, fmt.Errorf("invalid tile %v", tile)
+	}
+	return tile, nil
+}
+
+// mvtSource picks the indexed tile to query for a requested tile and the
+// level whose cells become features.
+//
+// Within the indexed range the requested tile is filled with its children
+// mvtDetail levels below, clamped at maxZoom. Beyond maxZoom (overzoom) the
+// maxZoom ancestor is used, so its single cell covers the whole tile.
+func mvtSource(tile maptile.Tile, overzoom int) (within maptile.Tile, level int, ok bool) {
+	z := int(tile.Z)
+	if z > maxZoom+overzoom {
+		return maptile.Tile{}, 0, false
+	}
+	if z > maxZoom {
+		return maptile.New(tile.X>>(z-maxZoom), tile.Y>>(z-maxZoom), maptile.Zoom(maxZoom)), maxZoom, true
+	}
+	level = z + mvtDetail
+	if level > maxZoom {
+		level = maxZoom
+	}
+	return tile, level, true
+}
+
+// handleMVT serves the counts inside a tile as polygons in the `tiles` layer.
+//
+//	/tiles/{z}/{x}/{y}.mvt
+func handleMVT(w http.ResponseWriter, r *http.Request, repo RecordRepo, opts Options) {
+	if _, ok := projection.(WebMercator); !ok {
+		http.Error(w, "vector tiles need -projection webmercator", http.StatusNotImplemented)
+		return
+	}
+	if opts.GridSize > 0 {
+		http.Error(w, "vector tiles need map tiles, not -grid-size", http.StatusBadRequest)
+		return
+	}
+	tile, err := parseTilePath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	within, level, ok := mvtSource(tile, opts.Overzoom)
+	if !ok {
+		http.Error(w, fmt.Sprintf("zoom %d beyond max zoom %d plus overzoom %d", tile.Z, maxZoom, opts.Overzoom), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	opts.Within = TileKey(within)
+	stats, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		writeAggregateError(w, err)
+		return
+	}
+
+	data, err := encodeMVT(tile, stats, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeCached(w, r, "application/vnd.mapbox-vector-tile", data, opts.CacheMaxAge)
+}
+
+// encodeMVT encodes stats, cells inside tile, as polygons of its `tiles`
+// layer.
+func encodeMVT(tile maptile.Tile, stats []RawStats, opts Options) ([]byte, error) {
+	fc := geojson.NewFeatureCollection()
+	for _, item := range stats {
+		cell, err := ParseTileKey(item.ID)
+		if err != nil {
+			continue
+		}
+		feature := geojson.NewFeature(cell.Bound().ToPolygon())
+		feature.Properties["count"] = clampCount(item.Count, opts)
+		if opts.ClampCount > 0 {
+			feature.Properties["rawCount"] = item.Count
+		}
+		feature.Properties["tileKey"] = item.ID
+		fc.Append(feature)
+	}
+	layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{mvtLayerName: fc})
+	layers.ProjectToTile(tile)
+	layers.Clip(mvt.MapboxGLDefaultExtentBound)
+	return mvt.Marshal(layers)
+}
+
+type dataSummary struct {
+	MinLng float64 `bson:"minLng"`
+	MinLat float64 `bson:"minLat"`
+	MaxLng float64 `bson:"maxLng"`
+	MaxLat float64 `bson:"maxLat"`
+	Count  int     `bson:"count"`
+}
+
+// summarizeData returns the bbox of all locations and the record count,
+// summing Record.Count like the aggregation.
+func summarizeData(ctx context.Context, repo RecordRepo) (dataSummary, error) {
+	lng := bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 0}}
+	lat := bson.M{"$arrayElemAt": bson.A{"$location.coordinates", 1}}
+	cursor, err := repo.Aggregate(ctx, bson.A{
+		bson.M{
+			"$group": bson.M{
+				"_id":    nil,
+				"minLng": bson.M{"$min": lng},
+				"minLat": bson.M{"$min": lat},
+				"maxLng": bson.M{"$max": lng},
+				"maxLat": bson.M{"$max": lat},
+				"count":  countSum,
+			},
+		},
+	})
+	if err != nil {
+		return dataSummary{}, err
+	}
+	res, err := xmongo.Decode[dataSummary](ctx, cursor)
+	if err != nil || len(res) == 0 {
+		return dataSummary{}, err
+	}
+	return res[0], nil
+}
+
+// TileJSON is the subset of https://github.com/mapbox/tilejson-spec 3.0.0
+// describing the MVT endpoint, plus the record count.
+type TileJSON struct {
+	TileJSON     string        `json:"tilejson"`
+	Tiles        []string      `json:"tiles"`
+	VectorLayers []VectorLayer `json:"vector_layers"`
+	MinZoom      int           `json:"minzoom"`
+	MaxZoom      int           `json:"maxzoom"`
+	Bounds       [4]float64    `json:"bounds"`
+	Count        int           `json:"count"`
+}
+
+type VectorLayer struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+// handleMetadata describes the MVT endpoint as TileJSON.
+//
+//	/metadata
+func handleMetadata(w http.ResponseWriter, r *http.Request, repo RecordRepo, opts Options) {
+	if opts.GridSize > 0 {
+		http.Error(w, "vector tiles need map tiles, not -grid-size", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	summary, err := summarizeData(ctx, repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	tileJSON := TileJSON{
+		TileJSON: "3.0.0",
+		Tiles:    []string{fmt.Sprintf("%s://%s/tiles/{z}/{x}/{y}.mvt", scheme, r.Host)},
+		VectorLayers: []VectorLayer{
+			{ID: mvtLayerName, Fields: map[string]string{"count": "Number", "tileKey": "String"}},
+		},
+		MinZoom: minZoom,
+		MaxZoom: maxZoom + opts.Overzoom,
+		Bounds:  [4]float64{summary.MinLng, summary.MinLat, summary.MaxLng, summary.MaxLat},
+		Count:   summary.Count,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tileJSON); err != nil {
+		log.Println("metadata write err", err.Error())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ndjsonFlushLines is how often exportNDJSON flushes and logs progress.
+const ndjsonFlushLines = 100000
+
+// writeNDJSON writes each feature of fc as one JSON line, without the
+// FeatureCollection around them.
+func writeNDJSON(w io.Writer, fc GeoJSONFeatures) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, feature := range fc.Features {
+		if err := enc.Encode(feature); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// exportNDJSON writes the aggregation at level to path as one feature per
+// line while the cursor yields tiles, so memory stays constant however many
+// there are. Options needing the whole result, like -normalize, must be
+// rejected by the caller. It returns the number of lines written.
+func exportNDJSON(ctx context.Context, repo RecordRepo, level int, opts Options, path string) (int, error) {
+	if opts.MaxFeatures > 0 {
+		count, err := countFeatures(ctx, repo, level, opts)
+		if err != nil {
+			return 0, err
+		}
+		if count > opts.MaxFeatures {
+			return 0, &TooManyFeaturesError{Count: count, Limit: opts.MaxFeatures}
+		}
+	}
+	if opts.Search != "" {
+		if err := checkSearchIndex(ctx, repo, opts.SearchIndex); err != nil {
+			return 0, err
+		}
+	}
+	approx, err := checkDistinctMemory(ctx, repo, level, opts)
+	if err != nil {
+		return 0, err
+	}
+	if approx {
+		return 0, fmt.Errorf("-distinct %s is over -limit-distinct-memory, -distinct-approx can't stream", opts.DistinctField)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	cursor, err := repo.Aggregate(ctx, buildPipeline(level, opts), aggregateOptions(opts))
+	if err != nil {
+		return 0, fmt.Errorf("aggregate: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	bw := bufio.NewWriter(file)
+	enc := json.NewEncoder(bw)
+	lines := 0
+	for cursor.Next(ctx) {
+		var item RawStats
+		if err := bson.Unmarshal(cursor.Current, &item); err != nil {
+			return lines, fmt.Errorf("decode: %w", err)
+		}
+		stats := []RawStats{item}
+		expandKeys(stats)
+		if opts.ROI != nil {
+			stats = clipToBound(stats, *opts.ROI, opts)
+		}
+		if opts.Boundary != nil {
+			stats = clipToPolygon(stats, opts.Boundary, opts)
+		}
+		if len(stats) == 0 {
+			continue
+		}
+		if err := enc.Encode(toFeatureCollection(stats, opts).Features[0]); err != nil {
+			return lines, err
+		}
+		lines++
+		if lines%ndjsonFlushLines == 0 {
+			if err := bw.Flush(); err != nil {
+				return lines, err
+			}
+			log.Printf("wrote %d lines to %s", lines, path)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return lines, err
+	}
+	if err := bw.Flush(); err != nil {
+		return lines, err
+	}
+	return lines, file.Close()
+}
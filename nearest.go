@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// NearestQuery asks for the K closest non-empty tiles to Point.
+type NearestQuery struct {
+	Point orb.Point
+	K     int
+}
+
+// maxNearest bounds -nearest k.
+const maxNearest = 1000
+
+// parseNearest parses lng,lat,k.
+func parseNearest(raw string) (NearestQuery, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 3 {
+		return NearestQuery{}, fmt.Errorf("nearest must be lng,lat,k, got %q", raw)
+	}
+	var lnglat [2]float64
+	for i, part := range parts[:2] {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return NearestQuery{}, fmt.Errorf("invalid nearest coordinate %q", part)
+		}
+		lnglat[i] = v
+	}
+	k, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil || k < 1 || k > maxNearest {
+		return NearestQuery{}, fmt.Errorf("nearest k must be an integer in [1, %d], got %q", maxNearest, parts[2])
+	}
+	query := NearestQuery{Point: orb.Point{lnglat[0], lnglat[1]}, K: k}
+	if err := validatePoint(query.Point, false); err != nil {
+		return NearestQuery{}, err
+	}
+	return query, nil
+}
+
+// NearTile is a non-empty tile and its distance to the queried point.
+type NearTile struct {
+	Stats    RawStats
+	Distance float64 // Great-circle meters from the point to the tile center
+}
+
+// tileOffset is how far the center of tile is from point, in tile widths
+// at the tile's zoom, taking the shorter way around the antimeridian.
+func tileOffset(point orb.Point, tile maptile.Tile) float64 {
+	origin := projection.At(point, tile.Z)
+	bound := projection.Bound(origin)
+	u := float64(origin.X) + (point.Lon()-bound.Min.Lon())/(bound.Max.Lon()-bound.Min.Lon())
+	v := float64(origin.Y) + (bound.Max.Lat()-point.Lat())/(bound.Max.Lat()-bound.Min.Lat())
+	n := float64(uint64(1) << tile.Z)
+	du := math.Abs(float64(tile.X) + 0.5 - u)
+	du = math.Min(du, n-du)
+	dv := float64(tile.Y) + 0.5 - v
+	return math.Hypot(du, dv)
+}
+
+// nearestTiles searches outward from the tile holding query.Point, one ring
+// of neighbors per $in aggregation, until it has query.K non-empty tiles,
+// then a few rings more since tiles diagonal in one ring can be further
+// than the next ring's sides. Tiles are returned closest first, fewer than
+// K if there aren't as many within maxRingDistance tiles.
+func nearestTiles(ctx context.Context, repo RecordRepo, level int, query NearestQuery, opts Options) ([]NearTile, error) {
+	z := maptile.Zoom(storedZoom(level, opts))
+	found := make([]RawStats, 0, query.K)
+	seen := make(map[string]bool)
+	offsets := make([]float64, 0)
+	for d := 0; d <= maxRingDistance; d++ {
+		if len(offsets) >= query.K {
+			sort.Float64s(offsets)
+			// A tile d rings out is at least d-0.5 tile widths away.
+			if float64(d)-0.5 >= offsets[query.K-1] {
+				break
+			}
+		}
+		ring := TileRing{Center: query.Point, K: d, Min: d}
+		fresh := false
+		for _, key := range RingKeys(ring, z) {
+			if !seen[key.(string)] {
+				seen[key.(string)], fresh = true, true
+			}
+		}
+		if !fresh {
+			// The rings wrapped around the whole world.
+			break
+		}
+		opts.Ring = &ring
+		stats, err := aggregate(ctx, repo, level, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range stats {
+			tile, err := ParseTileKey(item.ID)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, item)
+			offsets = append(offsets, tileOffset(query.Point, tile))
+		}
+	}
+	res := make([]NearTile, len(found))
+	for i, item := range found {
+		tile, _ := ParseTileKey(item.ID)
+		center := projection.Center(tile)
+		res[i] = NearTile{Stats: item, Distance: haversine([2]float64{query.Point.Lon(), query.Point.Lat()}, [2]float64{center.Lon(), center.Lat()})}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Distance < res[j].Distance })
+	if len(res) > query.K {
+		res = res[:query.K]
+	}
+	return res, nil
+}
+
+func nearestDemo(ctx context.Context, repo RecordRepo, level int, query NearestQuery, opts Options) {
+	tiles, err := nearestTiles(ctx, repo, level, query, opts)
+	if err != nil {
+		log.Panicln("Nearest err", err.Error())
+	}
+	stats := make([]RawStats, len(tiles))
+	for i, tile := range tiles {
+		stats[i] = tile.Stats
+	}
+	keep := opts.OutputProperties
+	opts.OutputProperties = nil
+	res := toFeatureCollection(stats, opts)
+	for i := range res.Features {
+		res.Features[i].Properties["distance"] = tiles[i].Distance
+	}
+	selectProperties(res.Features, keep)
+	printJSON(res, opts.Indent)
+	if len(tiles) < query.K {
+		log.Printf("found %d of %d tiles within %d tiles of %v", len(tiles), query.K, maxRingDistance, query.Point)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ParseOptions controls how source rows are turned into records.
+type ParseOptions struct {
+	DecimalSeparator   string             // "." or ",", the other one is a thousands separator
+	GridSize           float64            // Also store a GridCell of this size in meters, 0 to skip
+	CountColumn        string             // Header of a column with pre-aggregated counts
+	RequiredProperties RequiredProperties // GeoJSON features lacking one are skipped
+	TimeColumn         string             // Header, or GeoJSON property, of an RFC 3339 event time
+	WKTColumn          string             // Header of a WKT geometry column replacing lat,lng
+	Dataset            string             // Namespace prefixed to level keys, empty for none
+	TileGeometry       bool               // Also store level polygons, see Record.SetLevelGeometries
+	// DeterministicIDs derives _id from SourceKey so re-imports get the same
+	// IDs, losing the creation time a normal ObjectID embeds.
+	DeterministicIDs bool
+	Limit            int         // Stop after this many valid records, 0 for all
+	OnError          string      // Key of onErrorModes
+	BadRows          *BadRows    // Optional, collects skipped rows
+	Rejects          *RejectFile // Optional, receives every bad row
+	// ValidateCoordinates also rejects 0,0, where failed geocoders put
+	// points. Non-finite and out of range coordinates are always rejected.
+	ValidateCoordinates bool
+	Fixed               *FixedLayout // Read fixed-width lines instead of CSV, nil for CSV
+	Timings             *Timings     // Optional, accumulates time spent in SetLevels
+}
+
+// Timings records how long each phase took, printed with -verbose.
+type Timings struct {
+	Parse     time.Duration
+	SetLevels time.Duration
+	Insert    time.Duration
+	Aggregate time.Duration
+}
+
+func (t Timings) String() string {
+	return fmt.Sprintf("parse=%v setLevels=%v insert=%v aggregate=%v", t.Parse, t.SetLevels, t.Insert, t.Aggregate)
+}
+
+// onErrorModes are the valid -on-error values.
+var onErrorModes = map[string]bool{
+	"skip": true, // Count bad rows, keep the first few in BadRows
+	"fail": true, // Abort on the first bad row
+}
+
+// maxBadRows is how many bad rows BadRows keeps.
+const maxBadRows = 5
+
+// BadRows keeps the first maxBadRows rows skipped by the parsers.
+type BadRows []string
+
+// reject records err for a bad row, the kind `line` or `feature` numbered
+// row, erroring instead if OnError is fail. raw is the row as read, if
+// available.
+func (opts ParseOptions) reject(kind string, row int, raw string, err error) error {
+	reason := fmt.Sprintf("%s %d: %v", kind, row, err)
+	if opts.Rejects != nil {
+		if err := opts.Rejects.Write(newRejection(row, raw, err)); err != nil {
+			return err
+		}
+	}
+	if opts.OnError == "fail" {
+		return fmt.Errorf("bad row, %s", reason)
+	}
+	if opts.BadRows != nil && len(*opts.BadRows) < maxBadRows {
+		*opts.BadRows = append(*opts.BadRows, reason)
+	}
+	return nil
+}
+
+// decimalSeparators are the valid -decimal-separator values.
+var decimalSeparators = map[string]bool{".": true, ",": true}
+
+// parseCoordinate parses a number from messy exports: surrounding spaces or
+// quotes are trimmed and thousands separators dropped before parsing. NaN
+// and infinities are rejected.
+func parseCoordinate(field, raw string, opts ParseOptions) (float64, error) {
+	value := strings.Trim(strings.TrimSpace(raw), `"'`)
+	value = strings.TrimSpace(value)
+	if opts.DecimalSeparator == "," {
+		value = strings.ReplaceAll(value, ".", "")
+		value = strings.ReplaceAll(value, ",", ".")
+	} else {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, &CoordinateError{Field: field, Value: raw, Reason: "not a number"}
+	}
+	return f, checkFinite(field, raw, f)
+}
+
+// newRecord builds a record at point with its levels, and grid cell if
+// configured.
+func newRecord(point orb.Point, opts ParseOptions) Record {
+	record := Record{
+		ID:       primitive.NewObjectID(),
+		Location: GeoPoint{Type: "Point", Coordinates: []float64{point.Lon(), point.Lat()}},
+	}
+	if opts.GridSize > 0 {
+		cell := GridCellAt(point, opts.GridSize)
+		record.Grid = &cell
+	}
+	start := time.Now()
+	record.SetLevels()
+	record.SetDataset(opts.Dataset)
+	if opts.TileGeometry {
+		record.SetLevelGeometries()
+	}
+	if opts.Timings != nil {
+		opts.Timings.SetLevels += time.Since(start)
+	}
+	return record
+}
+
+// setID replaces the random _id with the first 12 bytes of SourceKey, a
+// sha1 hex digest, with DeterministicIDs.
+func (opts ParseOptions) setID(record *Record) {
+	if !opts.DeterministicIDs || len(record.SourceKey) < 24 {
+		return
+	}
+	if id, err := primitive.ObjectIDFromHex(record.SourceKey[:24]); err == nil {
+		record.ID = id
+	}
+}
+
+// parseCount reads a pre-aggregated count, missing or invalid values count
+// as a single record.
+func parseCount(raw string) int {
+	count, err := strconv.Atoi(strings.Trim(strings.TrimSpace(raw), `"'`))
+	if err != nil || count < 0 {
+		return 1
+	}
+	return count
+}
+
+// columnIndex finds name in header, -1 when name is empty.
+func columnIndex(header []string, name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	for i, column := range header {
+		if strings.TrimSpace(column) == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("column %q not in header %v", name, header)
+}
+
+// csvRecord converts one CSV row with `lat,lng` first, or a WKT geometry in
+// wktColumn. wktColumn, countColumn and timeColumn are -1 if absent.
+func csvRecord(rawparts []string, columns, wktColumn, countColumn, timeColumn int, opts ParseOptions) (Record, error) {
+	if len(rawparts) != columns || (columns < 2 && wktColumn < 0) {
+		return Record{}, fmt.Errorf("%d columns, header has %d", len(rawparts), columns)
+	}
+	var record Record
+	var err error
+	if wktColumn >= 0 {
+		record, err = newShapeRecord(strings.TrimSpace(rawparts[wktColumn]), opts)
+		if err != nil {
+			return Record{}, err
+		}
+	} else {
+		lat_float, err := parseCoordinate("lat", rawparts[0], opts)
+		if err != nil {
+			return Record{}, err
+		}
+		long_float, err := parseCoordinate("lng", rawparts[1], opts)
+		if err != nil {
+			return Record{}, err
+		}
+		point := orb.Point{long_float, lat_float}
+		if err := validatePoint(point, opts.ValidateCoordinates); err != nil {
+			return Record{}, err
+		}
+		record = newRecord(point, opts)
+	}
+	if timeColumn >= 0 {
+		timestamp, err := time.Parse(time.RFC3339, strings.Trim(strings.TrimSpace(rawparts[timeColumn]), `"'`))
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid %s %q", opts.TimeColumn, rawparts[timeColumn])
+		}
+		record.Timestamp = &timestamp
+	}
+	if countColumn >= 0 {
+		count := parseCount(rawparts[countColumn])
+		record.Count = &count
+	}
+	return record, nil
+}
+
+// ParseCSV reads rows starting with `lat,lng` after a header line. Both LF
+// and CRLF line endings are accepted. Rows whose coordinates still fail to
+// parse after cleanup are skipped and counted.
+func ParseCSV(r io.Reader, opts ParseOptions) (records []Record, failed int, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return []Record{}, 0, nil
+		}
+		return nil, 0, fmt.Errorf("read header: %w", err)
+	}
+	columns := len(header)
+	countColumn, err := columnIndex(header, opts.CountColumn)
+	if err != nil {
+		return nil, 0, err
+	}
+	timeColumn, err := columnIndex(header, opts.TimeColumn)
+	if err != nil {
+		return nil, 0, err
+	}
+	wktColumn, err := columnIndex(header, opts.WKTColumn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ret := make([]Record, 0)
+	for {
+		if opts.Limit > 0 && len(ret) >= opts.Limit {
+			break
+		}
+		rawparts, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if err := opts.reject("line", parseErr.Line, "", parseErr.Err); err != nil {
+				return nil, failed, err
+			}
+			failed++
+			continue
+		}
+		if err != nil {
+			return nil, failed, err
+		}
+		index, _ := reader.FieldPos(0)
+		record, err := csvRecord(rawparts, columns, wktColumn, countColumn, timeColumn, opts)
+		if err != nil {
+			if err := opts.reject("line", index, strings.Join(rawparts, ","), err); err != nil {
+				return nil, failed, err
+			}
+			failed++
+			continue
+		}
+		record.SourceKey = RowKey(index-1, strings.Join(rawparts, ","))
+		record.Row = index
+		opts.setID(&record)
+		ret = append(ret, record)
+	}
+	return ret, failed, nil
+}
+
+// LoadInput parses a CSV, GeoJSON for .geojson and .json names, or
+// fixed-width file with opts.Fixed. It's streamed through gzip when the name
+// ends in .gz or gzipInput is set.
+func LoadInput(path string, gzipInput bool, opts ParseOptions) (records []Record, failed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipInput || strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, 0, fmt.Errorf("gzip %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	if opts.Fixed != nil {
+		return ParseFixed(r, *opts.Fixed, opts)
+	}
+	name := strings.TrimSuffix(path, ".gz")
+	if strings.HasSuffix(name, ".geojson") || strings.HasSuffix(name, ".json") {
+		return ParseGeoJSON(r, opts)
+	}
+	return ParseCSV(r, opts)
+}
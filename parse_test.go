@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseCSVCRLF parses a CSV exported on Windows and checks no row was
+// lost to a trailing \r.
+func TestParseCSVCRLF(t *testing.T) {
+	const input = "lat,lng\r\n40.74498869975404,-73.92496400467742\r\n40.59092877970669,-74.07240369698876\r\n"
+	records, failed, err := ParseCSV(strings.NewReader(input), ParseOptions{DecimalSeparator: "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || failed != 0 {
+		t.Fatalf("parsed %d records with %d failures, expected 2 and 0", len(records), failed)
+	}
+	if lng := records[1].Location.Coordinates[0]; lng != -74.07240369698876 {
+		t.Errorf("last column parsed as %v", lng)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresBatchSize is how many rows go in each INSERT.
+const postgresBatchSize = 500
+
+// postgresTableName limits -pg-table to plain, optionally schema qualified,
+// identifiers since it's interpolated into SQL.
+var postgresTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// writePostgres upserts rawRes into table as (tile_key, z, count,
+// center_lng, center_lat) rows, z being the stored zoom of the keys,
+// creating the table if missing. Centers follow -geometry.
+func writePostgres(ctx context.Context, dsn, table string, level int, rawRes []RawStats, opts Options) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	tile_key text PRIMARY KEY,
+	z integer NOT NULL,
+	count bigint NOT NULL,
+	center_lng double precision NOT NULL,
+	center_lat double precision NOT NULL
+)`, table))
+	if err != nil {
+		return fmt.Errorf("create table: %w", err)
+	}
+	features := toFeatureCollection(rawRes, opts).Features
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(rawRes); start += postgresBatchSize {
+		end := start + postgresBatchSize
+		if end > len(rawRes) {
+			end = len(rawRes)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 5*(end-start))
+		for i := start; i < end; i++ {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+			center := features[i].Geometry.Coordinates
+			args = append(args, rawRes[i].ID, storedZoom(level, opts), rawRes[i].Count, center[0], center[1])
+		}
+		query := fmt.Sprintf(`INSERT INTO %s (tile_key, z, count, center_lng, center_lat) VALUES %s
+ON CONFLICT (tile_key) DO UPDATE SET z = EXCLUDED.z, count = EXCLUDED.count,
+	center_lng = EXCLUDED.center_lng, center_lat = EXCLUDED.center_lat`, table, strings.Join(values, ", "))
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("upsert rows %d-%d: %w", start, end, err)
+		}
+	}
+	return tx.Commit()
+}
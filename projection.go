@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/maptile/tilecover"
+	"github.com/paulmach/orb/project"
+)
+
+// Projection lays the square z/x/y tile grid over the globe. Keys, the
+// pyramid and the aggregation are the same in every projection, only where
+// a tile lies on the globe differs.
+type Projection interface {
+	// At returns the tile containing point at z.
+	At(point orb.Point, z maptile.Zoom) maptile.Tile
+	// Bound returns the lng lat bound of tile.
+	Bound(tile maptile.Tile) orb.Bound
+	// Center returns the lng lat center of tile.
+	Center(tile maptile.Tile) orb.Point
+	// Cover returns the tiles g touches at z.
+	Cover(g orb.Geometry, z maptile.Zoom) (maptile.Set, error)
+}
+
+// projections are the valid -projection values.
+var projections = map[string]Projection{
+	"webmercator": WebMercator{}, // EPSG:3857 tiles of web maps, up to about 85° of latitude
+	"platecarree": PlateCarree{}, // EPSG:4326 quad tree, tiles of 360/2^z by 180/2^z degrees
+}
+
+// projection is used wherever tiles turn into places, replace it before
+// parsing input and it must match the stored data.
+var projection Projection = WebMercator{}
+
+// WebMercator is the standard tiling of orb's maptile.
+type WebMercator struct{}
+
+func (WebMercator) At(point orb.Point, z maptile.Zoom) maptile.Tile {
+	return maptile.At(point, z)
+}
+
+func (WebMercator) Bound(tile maptile.Tile) orb.Bound {
+	return tile.Bound()
+}
+
+func (WebMercator) Center(tile maptile.Tile) orb.Point {
+	return tile.Center()
+}
+
+func (WebMercator) Cover(g orb.Geometry, z maptile.Zoom) (maptile.Set, error) {
+	return tilecover.Geometry(g, z)
+}
+
+// PlateCarree maps longitude and latitude linearly to x and y, so at zoom z
+// the globe is 2^z by 2^z tiles from the north-west corner, twice as wide
+// as they are tall in degrees. It reaches the poles.
+type PlateCarree struct{}
+
+func (PlateCarree) At(point orb.Point, z maptile.Zoom) maptile.Tile {
+	n := float64(uint32(1) << z)
+	clamp := func(v float64) uint32 {
+		return uint32(math.Max(0, math.Min(n-1, math.Floor(v*n))))
+	}
+	return maptile.New(clamp((point.Lon()+180)/360), clamp((90-point.Lat())/180), z)
+}
+
+func (PlateCarree) Bound(tile maptile.Tile) orb.Bound {
+	n := float64(uint32(1) << tile.Z)
+	return orb.Bound{
+		Min: orb.Point{float64(tile.X)/n*360 - 180, 90 - float64(tile.Y+1)/n*180},
+		Max: orb.Point{float64(tile.X+1)/n*360 - 180, 90 - float64(tile.Y)/n*180},
+	}
+}
+
+func (p PlateCarree) Center(tile maptile.Tile) orb.Point {
+	return p.Bound(tile).Center()
+}
+
+// Cover moves g's latitudes to where Web Mercator puts the same tile rows
+// and covers that with tilecover. Edges curve in between, so a long edge
+// may miss or add a tile along it.
+func (PlateCarree) Cover(g orb.Geometry, z maptile.Zoom) (maptile.Set, error) {
+	return tilecover.Geometry(project.Geometry(orb.Clone(g), func(p orb.Point) orb.Point {
+		y := (90 - p.Lat()) / 180
+		return orb.Point{p.Lon(), math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi}
+	}), z)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// sortStats orders stats in Go the same way sortOrders does in MongoDB.
+func sortStats(stats []RawStats, order string) {
+	sort.Slice(stats, func(i, j int) bool {
+		if order == "count" && stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].ID < stats[j].ID
+	})
+}
+
+func totalCount(stats []RawStats) int {
+	total := 0
+	for _, item := range stats {
+		total += item.Count
+	}
+	return total
+}
+
+// RollUp derives the counts of every coarser zoom from the finest level by
+// summing into Parent() tiles, so the pyramid needs a single scan. The
+// returned map includes the finest level itself. With weighted, parents get
+// Lng and Lat at the count-weighted average of their children's centroids,
+// or centers for children without one.
+func RollUp(finest []RawStats, order string, weighted bool) (map[int][]RawStats, error) {
+	if len(finest) == 0 {
+		return map[int][]RawStats{}, nil
+	}
+	first, err := ParseTileKey(finest[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	finestZoom := int(first.Z)
+	levels := map[int][]RawStats{finestZoom: finest}
+	current := finest
+	for z := finestZoom - 1; z >= minZoom; z-- {
+		counts := make(map[maptile.Tile]int)
+		sums := make(map[maptile.Tile]orb.Point)
+		for _, item := range current {
+			tile, err := ParseTileKey(item.ID)
+			if err != nil {
+				return nil, err
+			}
+			counts[tile.Parent()] += item.Count
+			if weighted {
+				position := projection.Center(tile)
+				if item.Lng != nil && item.Lat != nil {
+					position = orb.Point{*item.Lng, *item.Lat}
+				}
+				sum := sums[tile.Parent()]
+				sums[tile.Parent()] = orb.Point{sum[0] + position[0]*float64(item.Count), sum[1] + position[1]*float64(item.Count)}
+			}
+		}
+		parents := make([]RawStats, 0, len(counts))
+		for tile, count := range counts {
+			parent := RawStats{ID: TileKey(tile), Count: count}
+			if weighted && count > 0 {
+				lng, lat := sums[tile][0]/float64(count), sums[tile][1]/float64(count)
+				parent.Lng, parent.Lat = &lng, &lat
+			}
+			parents = append(parents, parent)
+		}
+		sortStats(parents, order)
+		if totalCount(parents) != totalCount(finest) {
+			return nil, fmt.Errorf("roll up to zoom %d sums to %d, finest zoom sums to %d", z, totalCount(parents), totalCount(finest))
+		}
+		levels[z] = parents
+		current = parents
+	}
+	return levels, nil
+}
+
+// finestOpts aggregates the finest level of a pyramid, without -min-count
+// which applies to every level after the roll-up.
+func finestOpts(opts Options) Options {
+	opts.MinCount = MinCounts{}
+	return opts
+}
+
+// BuildPyramid rolls finest up to every coarser zoom, keyed by zoom, and
+// drops tiles below each zoom's -min-count.
+func BuildPyramid(finest []RawStats, opts Options) (map[int]GeoJSONFeatures, error) {
+	levels, err := RollUp(finest, opts.Sort, opts.Geometry == "centroid" || opts.Geometry == "weighted")
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int]GeoJSONFeatures, len(levels))
+	for z, stats := range levels {
+		res[z] = toFeatureCollection(filterMinCount(stats, opts.MinCount.At(z)), opts)
+	}
+	return res, nil
+}
+
+// writePyramid writes one `{z}.geojson` per level into dir, creating it if
+// missing.
+func writePyramid(dir string, pyramid map[int]GeoJSONFeatures, indent string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for z, fc := range pyramid {
+		content, err := marshalJSON(fc, indent)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d.geojson", z))
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			return err
+		}
+		log.Printf("wrote %s, %d features", path, len(fc.Features))
+	}
+	return nil
+}
+
+func pyramidDemo(ctx context.Context, repo RecordRepo, level int, opts Options) {
+	finest, err := aggregate(ctx, repo, level, finestOpts(opts))
+	if err != nil {
+		log.Panicln("Aggregate err", err.Error())
+	}
+	pyramid, err := BuildPyramid(finest, opts)
+	if err != nil {
+		log.Panicln("Pyramid err", err.Error())
+	}
+	for z, fc := range pyramid {
+		fc.setMetadata(z, opts)
+		pyramid[z] = fc
+	}
+	if opts.OutDir != "" {
+		if err := writePyramid(opts.OutDir, pyramid, opts.Indent); err != nil {
+			log.Panicln("Write err", err.Error())
+		}
+		return
+	}
+	printJSON(pyramid, opts.Indent)
+}
+
+// PyramidMismatch is a parent tile of a written pyramid whose count isn't
+// the sum of its children's.
+type PyramidMismatch struct {
+	Key      string
+	Count    int // The parent's count, 0 if it's missing
+	Children int // Sum of the children's counts one zoom finer
+}
+
+// readPyramid reads the `{z}.geojson` files of writePyramid in dir into
+// counts by tile key, keyed by zoom.
+func readPyramid(dir string) (map[int]map[string]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.geojson"))
+	if err != nil {
+		return nil, err
+	}
+	levels := make(map[int]map[string]int)
+	for _, path := range paths {
+		z, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".geojson"))
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fc struct {
+			MinCount   int `json:"minCount"`
+			ClampCount int `json:"clampCount"`
+			Features   []struct {
+				Properties struct {
+					TileKey  string   `json:"tileKey"`
+					Count    *float64 `json:"count"`
+					RawCount *float64 `json:"rawCount"`
+				} `json:"properties"`
+			} `json:"features"`
+		}
+		if err := json.Unmarshal(content, &fc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if fc.MinCount > 1 {
+			return nil, fmt.Errorf("%s: written with -min-count %d, the dropped tiles can't be summed", path, fc.MinCount)
+		}
+		counts := make(map[string]int, len(fc.Features))
+		for i, feature := range fc.Features {
+			// Clamped counts don't add up, rawCount has the real one.
+			count := feature.Properties.Count
+			if feature.Properties.RawCount != nil || fc.ClampCount > 0 {
+				count = feature.Properties.RawCount
+			}
+			if feature.Properties.TileKey == "" || count == nil {
+				return nil, fmt.Errorf("%s: feature %d lacks tileKey, count or with -clamp-count rawCount, written with -output-properties?", path, i)
+			}
+			counts[feature.Properties.TileKey] += int(*count)
+		}
+		levels[z] = counts
+	}
+	return levels, nil
+}
+
+// checkPyramid compares, for each zoom above the finest, every parent's
+// count with the sum of its children's and returns the discrepancies by
+// zoom. A zoom without its finer neighbor can't be checked and is skipped.
+func checkPyramid(levels map[int]map[string]int) (checked int, mismatches map[int][]PyramidMismatch, err error) {
+	mismatches = make(map[int][]PyramidMismatch)
+	for z, children := range levels {
+		parents, ok := levels[z-1]
+		if !ok {
+			continue
+		}
+		sums := make(map[string]int, len(parents))
+		for key, count := range children {
+			tile, err := ParseTileKey(key)
+			if err != nil {
+				return checked, nil, fmt.Errorf("zoom %d: %w", z, err)
+			}
+			sums[TileKey(tile.Parent())] += count
+		}
+		for key := range parents {
+			if _, ok := sums[key]; !ok {
+				sums[key] = 0
+			}
+		}
+		for key, sum := range sums {
+			checked++
+			if parents[key] != sum {
+				mismatches[z-1] = append(mismatches[z-1], PyramidMismatch{Key: key, Count: parents[key], Children: sum})
+			}
+		}
+		sort.Slice(mismatches[z-1], func(i, j int) bool { return mismatches[z-1][i].Key < mismatches[z-1][j].Key })
+	}
+	return checked, mismatches, nil
+}
+
+// checkPyramidDemo checks the pyramid written to dir and reports every
+// discrepancy, false if there were any.
+func checkPyramidDemo(dir string) bool {
+	levels, err := readPyramid(dir)
+	if err != nil {
+		panic(err)
+	}
+	if len(levels) == 0 {
+		log.Panicln("invalid -check-pyramid, no {z}.geojson files in", dir)
+	}
+	checked, mismatches, err := checkPyramid(levels)
+	if err != nil {
+		panic(err)
+	}
+	zooms := make([]int, 0, len(mismatches))
+	total := 0
+	for z := range mismatches {
+		zooms = append(zooms, z)
+		total += len(mismatches[z])
+	}
+	sort.Ints(zooms)
+	for _, z := range zooms {
+		for _, m := range mismatches[z] {
+			fmt.Printf("zoom %d tile %s: count %d, children sum to %d\n", z, m.Key, m.Count, m.Children)
+		}
+	}
+	fmt.Printf("checked %d parents, %d mismatched\n", checked, total)
+	return total == 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestRollUp rolls a small zoom 2 level up and checks every parent's count,
+// that each level sums to the finest one and, weighted, the parents'
+// count-weighted centroids.
+func TestRollUp(t *testing.T) {
+	key := func(x, y uint32, z maptile.Zoom) string { return TileKey(maptile.New(x, y, z)) }
+	lng, lat := -120.0, 60.0
+	finest := []RawStats{
+		{ID: key(0, 0, 2), Count: 1, Lng: &lng, Lat: &lat},
+		{ID: key(1, 1, 2), Count: 3},
+		{ID: key(2, 0, 2), Count: 2},
+		{ID: key(3, 3, 2), Count: 4},
+	}
+	center := func(x, y uint32, z maptile.Zoom) orb.Point { return projection.Center(maptile.New(x, y, z)) }
+	weigh := func(points []orb.Point, counts []float64) orb.Point {
+		var sum orb.Point
+		var total float64
+		for i, point := range points {
+			sum[0] += point[0] * counts[i]
+			sum[1] += point[1] * counts[i]
+			total += counts[i]
+		}
+		return orb.Point{sum[0] / total, sum[1] / total}
+	}
+	northWest := weigh([]orb.Point{{lng, lat}, center(1, 1, 2)}, []float64{1, 3})
+	counts := map[int]map[string]int{
+		2: {key(0, 0, 2): 1, key(1, 1, 2): 3, key(2, 0, 2): 2, key(3, 3, 2): 4},
+		1: {key(0, 0, 1): 4, key(1, 0, 1): 2, key(1, 1, 1): 4},
+		0: {key(0, 0, 0): 10},
+	}
+	centroids := map[string]orb.Point{
+		key(0, 0, 1): northWest,
+		key(1, 0, 1): center(2, 0, 2),
+		key(1, 1, 1): center(3, 3, 2),
+		key(0, 0, 0): weigh([]orb.Point{northWest, center(2, 0, 2), center(3, 3, 2)}, []float64{4, 2, 4}),
+	}
+	tests := []struct {
+		name     string
+		order    string
+		weighted bool
+	}{
+		{"by key", "key", false},
+		{"by count", "count", false},
+		{"weighted", "key", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			levels, err := RollUp(finest, tt.order, tt.weighted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(levels) != len(counts) {
+				t.Fatalf("%d levels, expected %d", len(levels), len(counts))
+			}
+			for z, want := range counts {
+				stats := levels[z]
+				if got := totalCount(stats); got != totalCount(finest) {
+					t.Errorf("zoom %d sums to %d, expected %d", z, got, totalCount(finest))
+				}
+				if len(stats) != len(want) {
+					t.Errorf("zoom %d has %d tiles, expected %d", z, len(stats), len(want))
+				}
+				for _, item := range stats {
+					if item.Count != want[item.ID] {
+						t.Errorf("tile %s count %d, expected %d", item.ID, item.Count, want[item.ID])
+					}
+					if z == 2 {
+						continue
+					}
+					if !tt.weighted {
+						if item.Lng != nil || item.Lat != nil {
+							t.Errorf("tile %s has a centroid unweighted", item.ID)
+						}
+						continue
+					}
+					if item.Lng == nil || item.Lat == nil {
+						t.Errorf("tile %s lacks a centroid", item.ID)
+						continue
+					}
+					if want := centroids[item.ID]; math.Abs(*item.Lng-want[0]) > 1e-9 || math.Abs(*item.Lat-want[1]) > 1e-9 {
+						t.Errorf("tile %s centroid (%v, %v), expected %v", item.ID, *item.Lng, *item.Lat, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxRingDistance bounds -ring k, the match lists (2k+1)^2 tile keys.
+const maxRingDistance = 50
+
+// TileRing is every tile within K tiles, in both directions, of the tile
+// holding Center.
+type TileRing struct {
+	Center orb.Point
+	K      int
+	Min    int // Skip tiles within Min-1 tiles, 0 for a full disk, K for its outermost ring
+}
+
+// parseRing parses lng,lat,k.
+func parseRing(raw string) (TileRing, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 3 {
+		return TileRing{}, fmt.Errorf("ring must be lng,lat,k, got %q", raw)
+	}
+	var lnglat [2]float64
+	for i, part := range parts[:2] {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return TileRing{}, fmt.Errorf("invalid ring coordinate %q", part)
+		}
+		lnglat[i] = v
+	}
+	k, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil || k < 0 || k > maxRingDistance {
+		return TileRing{}, fmt.Errorf("ring k must be an integer in [0, %d], got %q", maxRingDistance, parts[2])
+	}
+	ring := TileRing{Center: orb.Point{lnglat[0], lnglat[1]}, K: k}
+	if ring.Center.Lon() < -180 || ring.Center.Lon() > 180 || ring.Center.Lat() < -90 || ring.Center.Lat() > 90 {
+		return TileRing{}, fmt.Errorf("ring center %v out of range", ring.Center)
+	}
+	return ring, nil
+}
+
+// RingKeys returns the keys of the tiles in ring at zoom z, the square grid
+// analogue of H3's GridDisk. Columns wrap around the antimeridian, rows stop
+// at the poles.
+func RingKeys(ring TileRing, z maptile.Zoom) bson.A {
+	center := projection.At(ring.Center, z)
+	n := int64(1) << z
+	seen := make(map[string]bool)
+	keys := bson.A{}
+	for dy := -ring.K; dy <= ring.K; dy++ {
+		y := int64(center.Y) + int64(dy)
+		if y < 0 || y >= n {
+			continue
+		}
+		for dx := -ring.K; dx <= ring.K; dx++ {
+			if abs(dx) < ring.Min && abs(dy) < ring.Min {
+				continue
+			}
+			x := ((int64(center.X)+int64(dx))%n + n) % n
+			key := fmt.Sprintf("%d-%d-%d", x, y, z)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// ringDemo prints the tiles of opts.Ring and logs their summed count.
+func ringDemo(ctx context.Context, repo RecordRepo, level int, opts Options) {
+	rawRes, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		log.Panicln("Aggregate err", err.Error())
+	}
+	if err := writeOutput(os.Stdout, rawRes, storedZoom(level, opts), opts); err != nil {
+		log.Panicln("Output err", err.Error())
+	}
+	log.Printf("%d tiles with data within %d of %v, total count %d", len(rawRes), opts.Ring.K, opts.Ring.Center, totalCount(rawRes))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
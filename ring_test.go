@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestRingTotal aggregates a k=1 ring around Times Square through
+// MemoryRepo and compares its total with the seed records whose tile is
+// at most one tile away, counted in Go.
+func TestRingTotal(t *testing.T) {
+	repo, records := newSeedRepo(t)
+	ring := TileRing{Center: orb.Point{-73.985130, 40.758896}, K: 1}
+	center := projection.At(ring.Center, maptile.Zoom(memoryTestLevel))
+	want := 0
+	for _, record := range records {
+		tile := projection.At(orb.Point{record.Location.Coordinates[0], record.Location.Coordinates[1]}, maptile.Zoom(memoryTestLevel))
+		if abs(int(tile.X)-int(center.X)) <= 1 && abs(int(tile.Y)-int(center.Y)) <= 1 {
+			want++
+		}
+	}
+	if want == len(records) || want < 2 {
+		t.Fatalf("fixture: %d of %d records in the ring, expected some but not all", want, len(records))
+	}
+	stats, err := aggregate(context.Background(), repo, memoryTestLevel, Options{Ring: &ring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := totalCount(stats); got != want {
+		t.Errorf("ring total %d, expected %d", got, want)
+	}
+	if len(stats) > 9 {
+		t.Errorf("%d tiles, a k=1 ring has at most 9", len(stats))
+	}
+}
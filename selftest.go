@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// maxMercatorLat is the latitude limit of Web Mercator tiles.
+const maxMercatorLat = 85.05112878
+
+// CheckKeyRoundTrip indexes point with SetLevels and checks every level's
+// key parses back to the tile projection.At computes, and that the tile's
+// bound contains the point.
+func CheckKeyRoundTrip(point orb.Point) error {
+	record := Record{Location: GeoPoint{Type: "Point", Coordinates: []float64{point.Lon(), point.Lat()}}}
+	record.SetLevels()
+	for _, level := range record.Levels {
+		tile, err := ParseTileKey(level.Key)
+		if err != nil {
+			return fmt.Errorf("%v: %w", point, err)
+		}
+		if want := projection.At(point, maptile.Zoom(level.Z)); tile != want {
+			return fmt.Errorf("%v: key %s parses to %v, expected %v", point, level.Key, tile, want)
+		}
+		if bound := projection.Bound(tile); !bound.Contains(point) {
+			return fmt.Errorf("%v: tile %s bound %v doesn't contain the point", point, level.Key, bound)
+		}
+	}
+	return nil
+}
+
+// selfTest runs CheckKeyRoundTrip on n random points from a fixed seed, then
+// inserts them into a MemoryRepo and checks every level aggregates to the
+// counts of their tiles. It prints failures and returns how many there
+// were.
+func selfTest(ctx context.Context, n int, seed int64) int {
+	rnd := rand.New(rand.NewSource(seed))
+	failures := 0
+	points := make([]orb.Point, n)
+	for i := range points {
+		points[i] = orb.Point{rnd.Float64()*360 - 180, (rnd.Float64()*2 - 1) * maxMercatorLat}
+		if err := CheckKeyRoundTrip(points[i]); err != nil {
+			failures++
+			fmt.Println("FAIL", err.Error())
+		}
+	}
+
+	repo, err := NewMemoryRepo(nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, point := range points {
+		if _, err := InsertRecord(ctx, repo, point, ParseOptions{}); err != nil {
+			panic(err)
+		}
+	}
+	for level := minZoom; level <= maxZoom; level++ {
+		want := make(map[string]int)
+		for _, point := range points {
+			want[TileKey(projection.At(point, maptile.Zoom(level)))]++
+		}
+		stats, err := aggregate(ctx, repo, level, Options{})
+		if err != nil {
+			panic(err)
+		}
+		for _, item := range stats {
+			if item.Count != want[item.ID] {
+				failures++
+				fmt.Printf("FAIL level %d tile %s: count %d, expected %d\n", level, item.ID, item.Count, want[item.ID])
+			}
+			delete(want, item.ID)
+		}
+		for key, count := range want {
+			failures++
+			fmt.Printf("FAIL level %d tile %s: missing, expected count %d\n", level, key, count)
+		}
+	}
+	fmt.Printf("selftest: %d points, %d failures\n", n, failures)
+	return failures
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+
+	defaultRamp = "#ffffcc,#fd8d3c,#800026"
+
+	// Limit a single PNG to avoid huge allocations from careless requests.
+	maxImageSide = 4096
+	// Same for occupancy bitmaps, 2MB once packed.
+	maxOccupancyBits = 1 << 24
+)
+
+func serve(addr string, repo RecordRepo, changes ChangeSource, defaultLevel int, opts Options) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heatmap.png", func(w http.ResponseWriter, r *http.Request) {
+		handleHeatmapPNG(w, r, repo, defaultLevel, opts)
+	})
+	mux.HandleFunc("/occupancy", func(w http.ResponseWriter, r *http.Request) {
+		handleOccupancy(w, r, repo, defaultLevel, opts)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleStream(w, r, repo, defaultLevel, opts)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWS(w, r, repo, changes, defaultLevel, opts)
+	})
+	mux.HandleFunc("/tiles", func(w http.ResponseWriter, r *http.Request) {
+		handleMultiLevel(w, r, repo, opts)
+	})
+	mux.HandleFunc("/tiles/", func(w http.ResponseWriter, r *http.Request) {
+		handleMVT(w, r, repo, opts)
+	})
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		handleMetadata(w, r, repo, opts)
+	})
+	log.Println("listening on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// writeAggregateError replies 413 for oversized aggregations, 500 otherwise.
+func writeAggregateError(w http.ResponseWriter, err error) {
+	var tooMany *TooManyFeaturesError
+	if errors.As(err, &tooMany) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeCached writes data with Cache-Control and a content hash ETag,
+// replying 304 when the client already has it. Since the ETag follows the
+// content, any write to the collection changes it for affected tiles.
+func writeCached(w http.ResponseWriter, r *http.Request, contentType string, data []byte, maxAge time.Duration) {
+	sum := sha1.Sum(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(data); err != nil {
+		log.Println("write err", err.Error())
+	}
+}
+
+// parseLevel reads the `level` query parameter, falls back to defaultLevel.
+func parseLevel(r *http.Request, defaultLevel int) (int, error) {
+	raw := r.URL.Query().Get("level")
+	if raw == "" {
+		return defaultLevel, nil
+	}
+	level, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid level %q", raw)
+	}
+	if level < minZoom || level > maxZoom {
+		return 0, fmt.Errorf("level %d out of range [%d, %d]", level, minZoom, maxZoom)
+	}
+	return level, nil
+}
+
+// tileRange returns the north-west and south-east tiles covering bound.
+func tileRange(bound orb.Bound, level int) (topLeft, bottomRight maptile.Tile) {
+	topLeft = projection.At(orb.Point{bound.Min.Lon(), bound.Max.Lat()}, maptile.Zoom(level))
+	bottomRight = projection.At(orb.Point{bound.Max.Lon(), bound.Min.Lat()}, maptile.Zoom(level))
+	return topLeft, bottomRight
+}
+
+// SnapBoundToTiles grows bound outward to the edges of the tiles covering
+// it at level z.
+func SnapBoundToTiles(bound orb.Bound, z int) orb.Bound {
+	topLeft, bottomRight := tileRange(bound, z)
+	return projection.Bound(topLeft).Union(projection.Bound(bottomRight))
+}
+
+// parseRamp parses comma separated `#rrggbb` colors.
+func parseRamp(raw string) ([]color.RGBA, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("ramp needs at least 2 colors, got %q", raw)
+	}
+	ramp := make([]color.RGBA, len(parts))
+	for i, part := range parts {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		v, err := strconv.ParseUint(part, 16, 32)
+		if err != nil || len(part) != 6 {
+			return nil, fmt.Errorf("invalid color %q", parts[i])
+		}
+		ramp[i] = color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+	}
+	return ramp, nil
+}
+
+// rampColor linearly interpolates ramp at t in [0, 1].
+func rampColor(ramp []color.RGBA, t float64) color.RGBA {
+	pos := t * float64(len(ramp)-1)
+	i := int(pos)
+	if i >= len(ramp)-1 {
+		return ramp[len(ramp)-1]
+	}
+	frac := pos - float64(i)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*frac)
+	}
+	lo, hi := ramp[i], ramp[i+1]
+	return color.RGBA{R: lerp(lo.R, hi.R), G: lerp(lo.G, hi.G), B: lerp(lo.B, hi.B), A: 0xff}
+}
+
+// renderHeatmap draws one scale*scale cell per tile between topLeft and
+// bottomRight (inclusive), empty tiles stay transparent.
+func renderHeatmap(stats []RawStats, topLeft, bottomRight maptile.Tile, scale int, ramp []color.RGBA) *image.RGBA {
+	width := int(bottomRight.X-topLeft.X+1) * scale
+	height := int(bottomRight.Y-topLeft.Y+1) * scale
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	maxCount := 0
+	for _, item := range stats {
+		if item.Count > maxCount {
+			maxCount = item.Count
+		}
+	}
+	if maxCount == 0 {
+		return img
+	}
+	for _, item := range stats {
+		tile, err := ParseTileKey(item.ID)
+		if err != nil || tile.X < topLeft.X || tile.X > bottomRight.X || tile.Y < topLeft.Y || tile.Y > bottomRight.Y {
+			continue
+		}
+		c := rampColor(ramp, float64(item.Count)/float64(maxCount))
+		px, py := int(tile.X-topLeft.X)*scale, int(tile.Y-topLeft.Y)*scale
+		for dy := 0; dy < scale; dy++ {
+			for dx := 0; dx < scale; dx++ {
+				img.SetRGBA(px+dx, py+dy, c)
+			}
+		}
+	}
+	return img
+}
+
+// handleHeatmapPNG renders counts at `level` within `bbox` as a PNG, each
+// tile becomes a `scale` pixels wide square.
+//
+//	/heatmap.png?level=12&bbox=-74.05,40.68,-73.90,40.82&scale=4
+func handleHeatmapPNG(w http.ResponseWriter, r *http.Request, repo RecordRepo, defaultLevel int, opts Options) {
+	level, err := parseLevel(r, defaultLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bound, err := parseBound(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scale := 4
+	if raw := r.URL.Query().Get("scale"); raw != "" {
+		scale, err = strconv.Atoi(raw)
+		if err != nil || scale <= 0 {
+			http.Error(w, fmt.Sprintf("invalid scale %q", raw), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Stats are keyed at the stored zoom, so is the image.
+	topLeft, bottomRight := tileRange(bound, storedZoom(level, opts))
+	if int(bottomRight.X-topLeft.X+1)*scale > maxImageSide || int(bottomRight.Y-topLeft.Y+1)*scale > maxImageSide {
+		http.Error(w, "image too large, use a smaller bbox, level or scale", http.StatusBadRequest)
+		return
+	}
+
+	// Only tiles touching bbox are drawn, no need to aggregate the rest.
+	// Snapped so the edge tiles are shaded by their full count.
+	opts.BBox, opts.SnapBBox = &bound, true
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	stats, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		writeAggregateError(w, err)
+		return
+	}
+
+	for i := range stats {
+		stats[i].Count = clampCount(stats[i].Count, opts)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, renderHeatmap(stats, topLeft, bottomRight, scale, opts.Ramp)); err != nil {
+		log.Println("png encode err", err.Error())
+	}
+}
+
+// Occupancy marks which tiles of a range have data. Bit i is tile
+// (X+i%Width, Y+i/Width): the origin is the north-west tile, rows run west
+// to east and go from north to south. Bits are packed MSB first.
+type Occupancy struct {
+	Level  int    `json:"level"`
+	X      uint32 `json:"x"`
+	Y      uint32 `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bits   []byte `json:"bits"` // base64 in JSON
+}
+
+func buildOccupancy(stats []RawStats, level int, topLeft, bottomRight maptile.Tile) Occupancy {
+	occ := Occupancy{
+		Level:  level,
+		X:      topLeft.X,
+		Y:      topLeft.Y,
+		Width:  int(bottomRight.X - topLeft.X + 1),
+		Height: int(bottomRight.Y - topLeft.Y + 1),
+	}
+	occ.Bits = make([]byte, (occ.Width*occ.Height+7)/8)
+	for _, item := range stats {
+		tile, err := ParseTileKey(item.ID)
+		if err != nil || item.Count == 0 || tile.X < topLeft.X || tile.X > bottomRight.X || tile.Y < topLeft.Y || tile.Y > bottomRight.Y {
+			continue
+		}
+		i := int(tile.Y-topLeft.Y)*occ.Width + int(tile.X-topLeft.X)
+		occ.Bits[i/8] |= 0x80 >> (i % 8)
+	}
+	return occ
+}
+
+// handleOccupancy returns an Occupancy bitmap of the tiles covering bbox.
+//
+//	/occupancy?level=12&bbox=-74.05,40.68,-73.90,40.82
+func handleOccupancy(w http.ResponseWriter, r *http.Request, repo RecordRepo, defaultLevel int, opts Options) {
+	level, err := parseLevel(r, defaultLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bound, err := parseBound(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stored := storedZoom(level, opts)
+	topLeft, bottomRight := tileRange(bound, stored)
+	if int(bottomRight.X-topLeft.X+1)*int(bottomRight.Y-topLeft.Y+1) > maxOccupancyBits {
+		http.Error(w, "bitmap too large, use a smaller bbox or level", http.StatusBadRequest)
+		return
+	}
+
+	// Tiles outside bbox aren't in the bitmap, skip their points.
+	opts.BBox, opts.SnapBBox = &bound, true
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	stats, err := aggregate(ctx, repo, level, opts)
+	if err != nil {
+		writeAggregateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buildOccupancy(stats, stored, topLeft, bottomRight)); err != nil {
+		log.Println("occupancy write err", err.Error())
+	}
+}
+
+// parseLevels reads the comma separated `levels` query parameter.
+func parseLevels(raw string) ([]int, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("levels is required, e.g. levels=8,10,12")
+	}
+	parts := strings.Split(raw, ",")
+	levels := make([]int, 0, len(parts))
+	for _, part := range parts {
+		level, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level %q", part)
+		}
+		if level < minZoom || level > maxZoom {
+			return nil, fmt.Errorf("level %d out of range [%d, %d]", level, minZoom, maxZoom)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// featureGeometries are the valid `geometry` query values.
+var featureGeometries = map[string]bool{
+	"point":   true, // -geometry placement, the default as it's the smallest
+	"polygon": true, // Tile footprint, for choropleths
+}
+
+// parseGeometry reads the `geometry` query parameter, point by default.
+func parseGeometry(r *http.Request) (string, error) {
+	raw := r.URL.Query().Get("geometry")
+	if raw == "" {
+		return "point", nil
+	}
+	if !featureGeometries[raw] {
+		return "", fmt.Errorf("invalid geometry %q, want point or polygon", raw)
+	}
+	return raw, nil
+}
+
+// GeoJSONPolygonFeatureItem is a GeoJSONFeatureItem with the tile footprint.
+type GeoJSONPolygonFeatureItem struct {
+	ID         string                 `json:"id,omitempty"`
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   GeoPolygon             `json:"geometry"`
+}
+
+type GeoJSONPolygonFeatures struct {
+	Type     string                      `json:"type"`
+	Features []GeoJSONPolygonFeatureItem `json:"features"`
+	Breaks   []float64                   `json:"breaks,omitempty"`
+}
+
+// toPolygonFeatures replaces the points of fc by the footprints of the
+// tiles in the feature IDs, keeping the IDs only if keepID.
+func toPolygonFeatures(fc GeoJSONFeatures, keepID bool) (GeoJSONPolygonFeatures, error) {
+	res := GeoJSONPolygonFeatures{Type: fc.Type, Features: make([]GeoJSONPolygonFeatureItem, len(fc.Features)), Breaks: fc.Breaks}
+	for i, feature := range fc.Features {
+		orbTile, err := ParseTileKey(feature.ID)
+		if err != nil {
+			return GeoJSONPolygonFeatures{}, err
+		}
+		tile := Tile{X: orbTile.X, Y: orbTile.Y, Z: uint32(orbTile.Z)}
+		res.Features[i] = GeoJSONPolygonFeatureItem{Type: feature.Type, Properties: feature.Properties, Geometry: tile.Polygon()}
+		if keepID {
+			res.Features[i].ID = feature.ID
+		}
+	}
+	return res, nil
+}
+
+// handleMultiLevel serves `/tiles?levels=8,10,12` as an object of zoom to
+// FeatureCollection. It aggregates once at the finest level and rolls up
+// the others like -pyramid. `geometry=polygon` returns tile footprints
+// instead of points.
+func handleMultiLevel(w http.ResponseWriter, r *http.Request, repo RecordRepo, opts Options) {
+	if opts.GridSize > 0 {
+		http.Error(w, "levels need map tiles, not -grid-size", http.StatusBadRequest)
+		return
+	}
+	levels, err := parseLevels(r.URL.Query().Get("levels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	geometry, err := parseGeometry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	finest := levels[0]
+	for _, level := range levels {
+		if level > finest {
+			finest = level
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	stats, err := aggregate(ctx, repo, finest, finestOpts(opts))
+	if err != nil {
+		writeAggregateError(w, err)
+		return
+	}
+	// Polygons need the tile key of each feature whatever -feature-id says.
+	pyramidOpts := opts
+	pyramidOpts.FeatureID = opts.FeatureID || geometry == "polygon"
+	pyramid, err := BuildPyramid(stats, pyramidOpts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := make(map[int]interface{}, len(levels))
+	for _, level := range levels {
+		fc, ok := pyramid[storedZoom(level, opts)]
+		if !ok {
+			fc = GeoJSONFeatures{Type: "FeatureCollection", Features: []GeoJSONFeatureItem{}}
+		}
+		if geometry == "point" {
+			res[level] = fc
+			continue
+		}
+		polygons, err := toPolygonFeatures(fc, opts.FeatureID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res[level] = polygons
+	}
+	content, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeCached(w, r, "application/json", content, opts.CacheMaxAge)
+}
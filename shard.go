@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sharding is an advanced, optional setup. Tile keys make a poor shard key:
+// neighbouring tiles share key prefixes, so dense areas would pile onto one
+// shard. Hashing spreads records evenly, at the price of every aggregation
+// reaching all shards, which it does anyway since it groups the whole
+// collection.
+
+// ShardHash is the 64 bit FNV-1a hash of value, as a signed int for BSON.
+func ShardHash(value string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return int64(h.Sum64())
+}
+
+// setShardKeys stores ShardHash of field in each record's ShardKey: the
+// hex _id for "_id", otherwise properties.<field>, falling back to _id for
+// records without it so every document has a shard key.
+func setShardKeys(records []Record, field string) {
+	for i := range records {
+		value := records[i].ID.Hex()
+		if v, ok := records[i].Properties[field]; ok && field != "_id" {
+			value = fmt.Sprint(v)
+		}
+		key := ShardHash(value)
+		records[i].ShardKey = &key
+	}
+}
+
+// shardField is the field collections are sharded on, the stored shardKey
+// when stored, _id otherwise.
+func shardField(stored bool) string {
+	if stored {
+		return "shardKey"
+	}
+	return "_id"
+}
+
+// shardCollection indexes and shards collection on a hashed shardField.
+// Needs a mongos, the database is enabled for sharding first as servers
+// before 6.0 require.
+func shardCollection(ctx context.Context, client *mongo.Client, collection *mongo.Collection, stored bool) error {
+	key := bson.D{{Key: shardField(stored), Value: "hashed"}}
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: key}); err != nil {
+		return fmt.Errorf("create hashed index: %w", err)
+	}
+	admin := client.Database("admin")
+	db := collection.Database().Name()
+	if err := admin.RunCommand(ctx, bson.D{{Key: "enableSharding", Value: db}}).Err(); err != nil {
+		return fmt.Errorf("enableSharding: %w", err)
+	}
+	namespace := db + "." + collection.Name()
+	if err := admin.RunCommand(ctx, bson.D{{Key: "shardCollection", Value: namespace}, {Key: "key", Value: key}}).Err(); err != nil {
+		return fmt.Errorf("shardCollection: %w", err)
+	}
+	return nil
+}
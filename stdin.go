@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+)
+
+// pointKey is a line of -stdin output.
+type pointKey struct {
+	Lng float64 `json:"lng"`
+	Lat float64 `json:"lat"`
+	Z   int     `json:"z"`
+	Key string  `json:"key"`
+}
+
+// writePointKeys reads `lng,lat` lines from r and writes the tile key of
+// each point at level to w as a JSON line, without a database. Blank lines
+// are skipped, malformed ones logged with their line number and counted.
+func writePointKeys(r io.Reader, w io.Writer, level int) (malformed int, err error) {
+	scanner := bufio.NewScanner(r)
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.Count(text, ",") != 1 {
+			log.Printf("stdin line %d: want lng,lat, got %q", line, text)
+			malformed++
+			continue
+		}
+		point, err := StubGeocoder{}.Geocode(context.Background(), text)
+		if err == nil {
+			err = validatePoint(point, false)
+		}
+		if err != nil {
+			log.Printf("stdin line %d: %v", line, err)
+			malformed++
+			continue
+		}
+		record := Record{Location: GeoPoint{Type: "Point", Coordinates: []float64{point.Lon(), point.Lat()}}}
+		record.SetLevels()
+		for _, tile := range record.Levels {
+			if int(tile.Z) != level {
+				continue
+			}
+			if err := encoder.Encode(pointKey{Lng: point.Lon(), Lat: point.Lat(), Z: level, Key: expandKey(tile.Key)}); err != nil {
+				return malformed, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return malformed, err
+	}
+	return malformed, out.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ringsaturn/xmongo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parseBucket parses a time.Duration, also accepting whole days like `1d`.
+func parseBucket(raw string) (time.Duration, error) {
+	if strings.HasSuffix(raw, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid bucket %q", raw)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid bucket %q", raw)
+	}
+	return d, nil
+}
+
+type frameStats struct {
+	ID struct {
+		Bucket int64  `bson:"bucket"` // Unix milliseconds of the bucket start
+		Key    string `bson:"key"`
+	} `bson:"_id"`
+	Count int `bson:"count"`
+}
+
+// buildFramePipeline counts records per tile, or -grid-size cell, and per
+// time bucket, ordered by bucket. Buckets are aligned to the Unix epoch and
+// -min-count applies to each bucket's counts.
+func buildFramePipeline(level int, bucket time.Duration, opts Options) bson.A {
+	match := buildMatch(level, opts)
+	if _, ok := match["timestamp"]; !ok {
+		match["timestamp"] = bson.M{"$exists": true}
+	}
+	key := levelKey(opts)
+	pipes := bson.A{
+		bson.M{
+			"$match": match,
+		},
+		bson.M{
+			"$unwind": "$levels",
+		},
+		bson.M{
+			"$match": buildLevelMatch(level, opts),
+		},
+	}
+	if opts.GridSize > 0 {
+		delete(match, "levels.z")
+		match["grid.size"] = opts.GridSize
+		key = "$grid.key"
+		pipes = bson.A{
+			bson.M{
+				"$match": match,
+			},
+		}
+	}
+	millis := bson.M{"$toLong": "$timestamp"}
+	pipes = append(pipes, bson.M{
+		"$group": bson.M{
+			"_id": bson.M{
+				"bucket": bson.M{"$subtract": bson.A{millis, bson.M{"$mod": bson.A{millis, bucket.Milliseconds()}}}},
+				"key":    key,
+			},
+			"count": countSum,
+		},
+	})
+	if floor := minCountFloor(level, opts); floor > 1 {
+		pipes = append(pipes, bson.M{"$match": bson.M{"count": bson.M{"$gte": floor}}})
+	}
+	return append(pipes, bson.M{
+		"$sort": bson.D{{Key: "_id.bucket", Value: 1}, {Key: "_id.key", Value: 1}},
+	})
+}
+
+// Frame is one time bucket of a replay.
+type Frame struct {
+	GeoJSONFeatures
+	Start time.Time `json:"start"` // Foreign member, start of the bucket
+}
+
+// handleStream replays per bucket counts as Server-Sent Events, one `frame`
+// event holding a FeatureCollection per bucket, paced by -playback-speed.
+//
+//	/stream?level=12&bucket=1d
+func handleStream(w http.ResponseWriter, r *http.Request, repo RecordRepo, defaultLevel int, opts Options) {
+	level, err := parseLevel(r, defaultLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bucket, err := parseBucket(r.URL.Query().Get("bucket"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	cursor, err := repo.Aggregate(ctx, buildFramePipeline(level, bucket, opts), aggregateOptions(opts))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rawRes, err := xmongo.Decode[frameStats](ctx, cursor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	delay := time.Duration(float64(time.Second) / opts.PlaybackSpeed)
+	for start := 0; start < len(rawRes); {
+		end := start
+		stats := make([]RawStats, 0)
+		for ; end < len(rawRes) && rawRes[end].ID.Bucket == rawRes[start].ID.Bucket; end++ {
+			stats = append(stats, RawStats{ID: expandKey(rawRes[end].ID.Key), Count: rawRes[end].Count})
+		}
+		frame := Frame{
+			GeoJSONFeatures: toFeatureCollection(stats, opts),
+			Start:           time.UnixMilli(rawRes[start].ID.Bucket).UTC(),
+		}
+		content, _ := json.Marshal(frame)
+		if _, err := fmt.Fprintf(w, "event: frame\ndata: %s\n\n", content); err != nil {
+			return
+		}
+		flusher.Flush()
+		start = end
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+	fmt.Fprint(w, "event: end\ndata: {}\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// flagGroups orders the -help output, flags missing here are listed under
+// "Other" so new ones still show up.
+var flagGroups = []struct {
+	name  string
+	flags []string
+}{
+	{"Input", []string{"insert", "reset", "yes", "input", "seed-demo", "demo-csv", "fixed", "gzip-input", "key-format", "projection", "count-column", "wkt-column", "require-prop", "time-column", "store-tile-geometry", "decimal-separator", "on-error", "validate-coordinates", "reject-file", "deterministic-ids", "limit-insert", "dataset", "grid-size", "write-concern", "dedup-key", "checkpoint", "resume", "strict", "txn", "shard-key-field", "shard"}},
+	{"Aggregation", []string{"level", "pyramid", "out-dir", "blend-level", "filter", "search", "search-index", "bbox", "row", "column", "ring", "nearest", "mask", "circle", "snap-bbox", "roi", "country-boundary", "country", "include-empty", "window", "zoom-offset", "collections", "report-collections", "union-with", "allow-disk-use", "cursor-batch-size", "max-features", "count-bins", "facet", "min-count", "follow"}},
+	{"Output", []string{"format", "out", "zoom-range", "tile-polygons", "geometry", "sort", "buckets", "classify", "normalize", "baseline", "baseline-collection", "baseline-metric", "kernel", "clamp-count", "log-scale", "distinct", "limit-distinct-memory", "distinct-approx", "feature-id", "output-properties", "indent", "ndjson-file", "pg-dsn", "pg-table"}},
+	{"Server", []string{"serve", "ramp", "playback-speed", "cache-max-age", "overzoom"}},
+	{"Connection", []string{"uri", "read-uri", "max-pool-size", "min-pool-size"}},
+	{"Tools", []string{"verify", "verify-sample", "estimate", "benchmark", "selftest", "geocode", "stdin", "check-pyramid", "dump-pipeline", "verbose", "max-runtime"}},
+}
+
+// flagValues lists the allowed values of enumerated flags, from the maps
+// they're validated against.
+var flagValues = map[string][]string{
+	"format":            mapKeys(formats),
+	"key-format":        mapKeys(keyFormats),
+	"projection":        mapKeys(projections),
+	"geometry":          mapKeys(geometries),
+	"sort":              mapKeys(sortOrders),
+	"classify":          mapKeys(classifiers),
+	"normalize":         mapKeys(normalizations),
+	"baseline-metric":   mapKeys(baselineMetrics),
+	"output-properties": mapKeys(outputProperties),
+	"on-error":          mapKeys(onErrorModes),
+	"decimal-separator": mapKeys(decimalSeparators),
+	"write-concern":     mapKeys(writeConcerns),
+}
+
+var usageExamples = []string{
+	"-insert -input points.csv.gz",
+	"-level 10 -sort count -buckets 5 -classify equal",
+	"-level 12 -format fgb -tile-polygons > tiles.fgb",
+	"-serve :8080 -max-features 50000",
+}
+
+// mapKeys returns the sorted keys of m, quoted if empty or punctuation
+// only, like "" or ".".
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if strings.IndexFunc(key, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			key = strconv.Quote(key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isZeroValue reports whether f's default is its type's zero value, like
+// the flag package's own check, such defaults aren't printed.
+func isZeroValue(f *flag.Flag) bool {
+	zero := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	return f.DefValue == zero.String()
+}
+
+// printFlag prints f like flag.PrintDefaults, then its allowed values.
+func printFlag(f *flag.Flag) {
+	out := flag.CommandLine.Output()
+	name, usage := flag.UnquoteUsage(f)
+	line := "  -" + f.Name
+	if name != "" {
+		line += " " + name
+	}
+	line += "\n    \t" + strings.ReplaceAll(usage, "\n", "\n    \t")
+	if !isZeroValue(f) {
+		if reflect.TypeOf(f.Value).Elem().Kind() == reflect.String {
+			line += fmt.Sprintf(" (default %q)", f.DefValue)
+		} else {
+			line += fmt.Sprintf(" (default %v)", f.DefValue)
+		}
+	}
+	if values, ok := flagValues[f.Name]; ok {
+		line += "\n    \tvalues: " + strings.Join(values, ", ")
+	}
+	fmt.Fprintln(out, line)
+}
+
+// usage prints the flags by group with their allowed values, set as
+// flag.Usage.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", flag.CommandLine.Name())
+	listed := make(map[string]bool)
+	for _, group := range flagGroups {
+		fmt.Fprintf(out, "\n%s:\n", group.name)
+		for _, name := range group.flags {
+			if f := flag.Lookup(name); f != nil {
+				printFlag(f)
+				listed[name] = true
+			}
+		}
+	}
+	var other []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		if !listed[f.Name] {
+			other = append(other, f)
+		}
+	})
+	if len(other) > 0 {
+		fmt.Fprintln(out, "\nOther:")
+		for _, f := range other {
+			printFlag(f)
+		}
+	}
+	fmt.Fprintln(out, "\nExamples:")
+	for _, example := range usageExamples {
+		fmt.Fprintf(out, "  %s %s\n", flag.CommandLine.Name(), example)
+	}
+}
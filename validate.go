@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/paulmach/orb"
+)
+
+// CoordinateError is why a coordinate was rejected.
+type CoordinateError struct {
+	Field  string // lat, lng, or lat,lng for the pair
+	Value  string // As read, or formatted if parsed
+	Reason string // not a number, NaN, infinite, out of range or null island
+}
+
+func (e *CoordinateError) Error() string {
+	return fmt.Sprintf("%s %q %s", e.Field, e.Value, e.Reason)
+}
+
+// checkFinite rejects the NaN and infinities strconv.ParseFloat accepts.
+func checkFinite(field, raw string, v float64) error {
+	if math.IsNaN(v) {
+		return &CoordinateError{Field: field, Value: raw, Reason: "NaN"}
+	}
+	if math.IsInf(v, 0) {
+		return &CoordinateError{Field: field, Value: raw, Reason: "infinite"}
+	}
+	return nil
+}
+
+// validatePoint rejects non-finite and out of range coordinates, and with
+// nullIsland the 0,0 that failed geocoders tend to emit.
+func validatePoint(point orb.Point, nullIsland bool) error {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for _, c := range []struct {
+		field string
+		v     float64
+		limit float64
+	}{{"lat", point.Lat(), 90}, {"lng", point.Lon(), 180}} {
+		if err := checkFinite(c.field, format(c.v), c.v); err != nil {
+			return err
+		}
+		if math.Abs(c.v) > c.limit {
+			return &CoordinateError{Field: c.field, Value: format(c.v), Reason: "out of range"}
+		}
+	}
+	if nullIsland && point.Lat() == 0 && point.Lon() == 0 {
+		return &CoordinateError{Field: "lat,lng", Value: "0,0", Reason: "null island"}
+	}
+	return nil
+}
+
+// Rejection is a bad row as written to -reject-file.
+type Rejection struct {
+	Row    int    // Line, or feature index for GeoJSON
+	Field  string // Offending field, empty if unknown
+	Reason string
+	Value  string // Offending value, empty if unknown
+	Raw    string // The row as read, empty if unavailable
+}
+
+// newRejection describes err of row, taking the field and value of a
+// CoordinateError.
+func newRejection(row int, raw string, err error) Rejection {
+	rejection := Rejection{Row: row, Reason: err.Error(), Raw: raw}
+	var coordErr *CoordinateError
+	if errors.As(err, &coordErr) {
+		rejection.Field, rejection.Value, rejection.Reason = coordErr.Field, coordErr.Value, coordErr.Reason
+	}
+	return rejection
+}
+
+// RejectFile writes every rejected row as CSV with a
+// `row,field,reason,value,raw` header.
+type RejectFile struct {
+	w     *csv.Writer
+	Count int
+}
+
+func NewRejectFile(w io.Writer) (*RejectFile, error) {
+	f := &RejectFile{w: csv.NewWriter(w)}
+	return f, f.w.Write([]string{"row", "field", "reason", "value", "raw"})
+}
+
+func (f *RejectFile) Write(r Rejection) error {
+	f.Count++
+	return f.w.Write([]string{strconv.Itoa(r.Row), r.Field, r.Reason, r.Value, r.Raw})
+}
+
+// Flush writes buffered rows, call it once parsing is done.
+func (f *RejectFile) Flush() error {
+	f.w.Flush()
+	return f.w.Error()
+}
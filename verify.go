@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// levelsMismatch describes how stored levels differ from those recomputed
+// from the record's location, or shape, empty if they match.
+func levelsMismatch(record Record) string {
+	if len(record.Location.Coordinates) != 2 {
+		return fmt.Sprintf("invalid location %v", record.Location.Coordinates)
+	}
+	expected := Record{Location: record.Location}
+	if record.Shape != "" {
+		g, err := parseShape(record.Shape)
+		if err != nil {
+			return err.Error()
+		}
+		if err := expected.SetLevelsCovering(g); err != nil {
+			return err.Error()
+		}
+	} else {
+		expected.SetLevels()
+	}
+	if len(record.Levels) > 0 {
+		dataset, _ := splitDatasetKey(record.Levels[0].Key)
+		expected.SetDataset(dataset)
+	}
+	if len(record.Levels) != len(expected.Levels) {
+		return fmt.Sprintf("has %d levels, expected %d", len(record.Levels), len(expected.Levels))
+	}
+	for i, tile := range record.Levels {
+		want := expected.Levels[i]
+		if tile.X != want.X || tile.Y != want.Y || tile.Z != want.Z || tile.Key != want.Key {
+			return fmt.Sprintf("level %d is %s, expected %s", i, tile.Key, want.Key)
+		}
+	}
+	return ""
+}
+
+// verifyLevels checks stored levels against location for every document, or
+// for a random sample of that size if sample > 0, and prints mismatches.
+func verifyLevels(ctx context.Context, repo RecordRepo, sample int) (checked, mismatched int, err error) {
+	pipes := bson.A{}
+	if sample > 0 {
+		pipes = append(pipes, bson.M{"$sample": bson.M{"size": sample}})
+	}
+	var cursor *mongo.Cursor
+	cursor, err = repo.Aggregate(ctx, pipes)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var record Record
+		if err := cursor.Decode(&record); err != nil {
+			return checked, mismatched, err
+		}
+		checked++
+		if reason := levelsMismatch(record); reason != "" {
+			mismatched++
+			fmt.Printf("mismatch %s: %s\n", record.ID.Hex(), reason)
+		}
+	}
+	return checked, mismatched, cursor.Err()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// maxRuntimeExitCode is the exit status after -max-runtime, as timeout(1)
+// uses.
+const maxRuntimeExitCode = 124
+
+// withMaxRuntime returns a context ending after d, no deadline if d is 0.
+// Since -serve, -follow or a stuck call may not watch it, the process also
+// exits with a message once d has passed.
+func withMaxRuntime(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	timer := time.AfterFunc(d, func() {
+		exitMaxRuntime(d)
+	})
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+func exitMaxRuntime(d time.Duration) {
+	log.Printf("exceeded -max-runtime %v, exiting", d)
+	os.Exit(maxRuntimeExitCode)
+}
+
+// recoverMaxRuntime turns a panic caused by ctx running out into the
+// -max-runtime exit, other panics continue. Defer it in main.
+func recoverMaxRuntime(ctx context.Context, d time.Duration) {
+	if r := recover(); r != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			exitMaxRuntime(d)
+		}
+		panic(r)
+	}
+}